@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clearing decides what happens to the lines we read from the log files when
+// shutting down. Only what we read is cleared, lines written after it are
+// kept. When archiveDir is set what is cleared is copied there first, and
+// gzipped when compress is set. A dryRun only logs what would be cleared.
+type clearing struct {
+	archiveDir string
+	compress   bool
+	dryRun     bool
+}
+
+// clearSources clears what was read from each of the sources. The sources'
+// offsets are moved back to the start, as that is where the lines we did not
+// read yet are now.
+func clearSources(sources []*source, c clearing) {
+	for _, s := range sources {
+		if err := clearSource(s, c); err != nil {
+			log.Println("Unable to clear file at location:", s.path)
+			log.Println(err)
+		}
+	}
+}
+
+// clearSource removes the part of the source's file we read from the front
+// of it, moving the rest to the front. The file itself is kept, so whoever
+// is writing to it can carry on doing so.
+func clearSource(s *source, c clearing) error {
+	offset := s.consumed()
+	switch {
+	case !s.isFile():
+		return nil
+	case offset < 0:
+		log.Println("Not clearing", s.path, "as we do not know how much of it was read")
+		return nil
+	case offset == 0:
+		return nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if id, ok := s.identity.Load().(fileID); ok {
+		if current, _ := identify(fi); current != id {
+			log.Println("Not clearing", s.path, "as it was replaced by another file after we read it")
+			return nil
+		}
+	}
+	if fi.Size() < offset {
+		log.Println("Not clearing", s.path, "as it was truncated after we read it")
+		return nil
+	}
+
+	archive := ""
+	if c.archiveDir != "" {
+		archive = archivePath(c, s)
+	}
+	if c.dryRun {
+		if archive != "" {
+			log.Println("Would clear", offset, "of", fi.Size(), "bytes from", s.path, "archiving them to", archive)
+		} else {
+			log.Println("Would clear", offset, "of", fi.Size(), "bytes from", s.path)
+		}
+		return nil
+	}
+
+	if archive != "" {
+		if err := archiveFile(f, offset, archive, c.compress); err != nil {
+			return err
+		}
+	}
+	kept, err := moveToFront(f, offset, fi.Size())
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&s.offset, 0)
+	log.Println("Cleared", offset, "bytes from", s.path+", kept the", kept, "bytes written after them")
+	return nil
+}
+
+// moveToFront moves what follows offset in f, up to size, to the front of it
+// and cuts off the rest, returning how many bytes were kept. The bytes are
+// moved before the file is cut, and lines appended while they are being moved
+// are moved along with them, so the file is only cut once nothing more was
+// written to it. The file is locked while checking that and cutting it, so
+// writers that lock it too can't append anything in between.
+func moveToFront(f *os.File, offset, size int64) (int64, error) {
+	var kept int64
+	for {
+		rest, err := ioutil.ReadAll(io.NewSectionReader(f, offset+kept, size-offset-kept))
+		if err != nil {
+			return kept, err
+		}
+		if _, err := f.WriteAt(rest, kept); err != nil {
+			return kept, err
+		}
+		kept += int64(len(rest))
+
+		unlock, err := lockFile(f)
+		if err != nil {
+			return kept, err
+		}
+		fi, err := f.Stat()
+		if err == nil && fi.Size() <= offset+kept {
+			err = f.Truncate(kept)
+			unlock()
+			return kept, err
+		}
+		unlock()
+		if err != nil {
+			return kept, err
+		}
+		size = fi.Size()
+	}
+}
+
+// archivePath is where what is cleared from the source is archived, named
+// after its label and the time it was cleared at.
+func archivePath(c clearing, s *source) string {
+	name := strings.Replace(s.label, string(filepath.Separator), "_", -1)
+	if name == "" {
+		name = filepath.Base(s.path)
+	}
+	path := filepath.Join(c.archiveDir, name+"."+time.Now().Format(rotatedLayout))
+	if c.compress {
+		path += ".gz"
+	}
+	return path
+}
+
+// archiveFile copies the first n bytes of f to the file at path.
+func archiveFile(f *os.File, n int64, path string, compress bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = out
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, n))
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
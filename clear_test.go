@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestMoveToFront(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		offset  int64
+		kept    string
+	}{
+		{"everything read", "a\nb\n", 4, ""},
+		{"the rest moved", "a\nb\nc\n", 2, "b\nc\n"},
+		{"a partial line kept", "a\nb", 2, "b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := tempFile(t, test.content)
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			kept, err := moveToFront(f, test.offset, int64(len(test.content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.kept || kept != int64(len(test.kept)) {
+				t.Errorf("got %q, %d bytes kept, want %q", b, kept, test.kept)
+			}
+		})
+	}
+}
+
+func TestMoveToFrontWithConcurrentAppends(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("files are not locked on windows")
+	}
+	const lines = 50000
+	var content bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&content, "read %d\n", i)
+	}
+	offset := int64(content.Len())
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&content, "kept %d\n", i)
+	}
+	f := tempFile(t, content.String())
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The writer takes the lock moveToFront cuts the file under, as a
+	// writer has to for no line to be lost.
+	w, err := os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < lines; i++ {
+			unlock, err := lockFile(w)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			fmt.Fprintf(w, "appended %d\n", i)
+			unlock()
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+
+	<-started
+	if _, err := moveToFront(f, offset, int64(content.Len())); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var want []string
+	for _, prefix := range []string{"kept", "appended"} {
+		for i := 0; i < lines; i++ {
+			want = append(want, fmt.Sprintf("%s %d", prefix, i))
+		}
+	}
+	next := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if next >= len(want) || scanner.Text() != want[next] {
+			t.Fatalf("got line %q after %d lines", scanner.Text(), next)
+		}
+		next++
+	}
+	if next != len(want) {
+		t.Errorf("got %d lines, want %d", next, len(want))
+	}
+}
+
+// tempFile returns a temporary file opened for reading and writing, holding
+// the content.
+func tempFile(t *testing.T, content string) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "aggregator-clear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f
+}
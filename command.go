@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/spf13/cast"
+)
+
+const (
+	// locationCommand is the Type of the entries under Locations that run a
+	// command.
+	locationCommand = "command"
+
+	// commandPrefix is what the paths of command locations start with, they
+	// have no path of their own.
+	commandPrefix = "command:"
+
+	defaultRestartDelay = time.Second
+
+	// commandStopTimeout is how long a command is given to exit once it is
+	// asked to, before it is killed.
+	commandStopTimeout = 5 * time.Second
+)
+
+var (
+	errInvalidCommand = errors.New("each entry with a Type of command must have a Command, either a command line or a list of arguments")
+	errStopped        = errors.New("the command was stopped")
+)
+
+// commandSpec is a command whose output is aggregated. A command that exits
+// is started again after restartDelay when restart is set.
+type commandSpec struct {
+	args         []string
+	dir          string
+	restart      bool
+	restartDelay time.Duration
+}
+
+// parseCommandLocation reads an entry of Locations with a Type of command. Its
+// Command is either a command line, which is run by the shell, or a list of
+// the arguments to run it with. Label defaults to the name of the command,
+// Dir, Restart and RestartDelay are optional.
+func parseCommandLocation(settings map[string]interface{}, defaults location) (location, error) {
+	spec := &commandSpec{
+		dir:          cast.ToString(settings["dir"]),
+		restart:      cast.ToBool(settings["restart"]),
+		restartDelay: defaultRestartDelay,
+	}
+	name := ""
+	switch raw := settings["command"].(type) {
+	case string:
+		if fields := strings.Fields(raw); len(fields) > 0 {
+			spec.args = shellCommand(raw)
+			name = fields[0]
+		}
+	case []interface{}:
+		spec.args = toStrings(raw)
+		if len(spec.args) > 0 {
+			name = spec.args[0]
+		}
+	}
+	if name == "" {
+		return location{}, errInvalidCommand
+	}
+	if v, ok := settings["restartdelay"]; ok {
+		spec.restartDelay = cast.ToDuration(v)
+	}
+
+	label := cast.ToString(settings["label"])
+	if label == "" {
+		label = filepath.Base(name)
+	}
+	l := defaults
+	l.path = commandPrefix + spec.String()
+	l.label = label
+	l.command = spec
+	return l, nil
+}
+
+// String is the command line of the spec with each of its arguments quoted,
+// followed by the directory it is run in when it is set. It is what the path
+// of its location is made of, so the same command is only run once.
+func (spec *commandSpec) String() string {
+	quoted := make([]string, len(spec.args))
+	for i, arg := range spec.args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	line := strings.Join(quoted, " ")
+	if spec.dir != "" {
+		line += " in " + strconv.Quote(spec.dir)
+	}
+	return line
+}
+
+// checkCommands returns an error for the first command that is listed more
+// than once among the locations.
+func checkCommands(locations []location) error {
+	seen := make(map[string]bool)
+	for _, l := range locations {
+		if l.command == nil {
+			continue
+		}
+		if seen[l.path] {
+			return fmt.Errorf("the command %s is listed more than once", strings.TrimPrefix(l.path, commandPrefix))
+		}
+		seen[l.path] = true
+	}
+	return nil
+}
+
+// startCommand starts the location's command, adding a source for its stdout
+// and one for its stderr, labeled by the command's label followed by the
+// name of the stream. Callers hold the lock.
+func (ts *tailSet) startCommand(l location) error {
+	p, err := startProcess(l)
+	if err != nil {
+		return err
+	}
+	streams := []struct {
+		name  string
+		lines <-chan *tail.Line
+	}{
+		{"stdout", p.stdout},
+		{"stderr", p.stderr},
+	}
+	for _, stream := range streams {
+		sl := l
+		sl.path = l.path + string(filepath.Separator) + stream.name
+		sl.label = l.label + "/" + stream.name
+		ts.startSource(&source{location: sl, lines: stream.lines, stop: p.stop})
+	}
+	return nil
+}
+
+// process runs a command for as long as we are aggregating its output,
+// restarting it when it exits if its location asks for that. The lines of its
+// stdout and stderr are sent to the channels of the same name, which are
+// closed once the command is done for good.
+type process struct {
+	location
+	stdout   chan *tail.Line
+	stderr   chan *tail.Line
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopped  bool
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startProcess starts the location's command.
+func startProcess(l location) (*process, error) {
+	p := &process{
+		location: l,
+		stdout:   make(chan *tail.Line),
+		stderr:   make(chan *tail.Line),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	cmd, output, err := p.spawn()
+	if err != nil {
+		return nil, err
+	}
+	go p.run(cmd, output)
+	return p, nil
+}
+
+// spawn starts the command once, output is done once both its stdout and
+// stderr were read to the end.
+func (p *process) spawn() (*exec.Cmd, *sync.WaitGroup, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, nil, errStopped
+	}
+
+	cmd := exec.Command(p.command.args[0], p.command.args[1:]...)
+	cmd.Dir = p.command.dir
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	p.cmd = cmd
+
+	output := &sync.WaitGroup{}
+	output.Add(2)
+	go readLines(stdout, p.stdout, output.Done)
+	go readLines(stderr, p.stderr, output.Done)
+	return cmd, output, nil
+}
+
+// run waits for the command to exit, starting it again when it should be
+// restarted.
+func (p *process) run(cmd *exec.Cmd, output *sync.WaitGroup) {
+	defer close(p.done)
+	defer close(p.stderr)
+	defer close(p.stdout)
+	for {
+		// The output has to be read to the end before waiting on the
+		// command, as waiting closes the pipes.
+		output.Wait()
+		err := cmd.Wait()
+		if p.isStopped() {
+			return
+		}
+		if err != nil {
+			log.Println("Command", p.label, "exited:", err)
+		} else {
+			log.Println("Command", p.label, "exited")
+		}
+		if !p.command.restart {
+			return
+		}
+
+		for {
+			select {
+			case <-time.After(p.command.restartDelay):
+			case <-p.quit:
+				return
+			}
+			if cmd, output, err = p.spawn(); err == nil {
+				break
+			}
+			if err == errStopped {
+				return
+			}
+			log.Println("Unable to restart command", p.label, err)
+		}
+		log.Println("Restarted command", p.label)
+	}
+}
+
+func (p *process) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// stop asks the command to exit, along with any processes it started, and
+// kills them when they do not within commandStopTimeout. That is not waited
+// for, the tailSet stops its sources while holding its lock, and this way
+// every command is asked to exit at once and they are given the time
+// together. It is safe to call more than once.
+func (p *process) stop() {
+	p.stopOnce.Do(func() {
+		p.mu.Lock()
+		p.stopped = true
+		cmd := p.cmd
+		p.mu.Unlock()
+		close(p.quit)
+
+		terminateProcess(cmd)
+		go func() {
+			select {
+			case <-p.done:
+			case <-time.After(commandStopTimeout):
+				log.Println("Command", p.label, "did not exit in time, killing it")
+				killProcess(cmd)
+			}
+		}()
+	})
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"errors"
-	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -17,10 +17,23 @@ var (
 
 type appConfig struct {
 	config            string
-	locations         []string
+	locations         []location
 	clearFilesOnClose bool
+	clearing          clearing
 	logToFile         string
-	logFile           *os.File
+	diagnosticsFile   string
+	diagnostics       *os.File
+	timePrefix        string
+	outputFormat      string
+	rotation          rotation
+	sinks             []sinkConfig
+	mergeWindow       time.Duration
+	stateFile         string
+	httpListen        string
+	historyLines      int
+	historySize       int64
+	shutdownTimeout   time.Duration
+	retryUnavailable  bool
 }
 
 // newConfigFromFlags reads in the vars that are casted from command line flags
@@ -28,10 +41,10 @@ type appConfig struct {
 func newConfigFromFlags() (*appConfig, error) {
 	var ac = &appConfig{}
 	ac.config = flagConfig
-	if len(flagLocations) > 0 && ac.config != "" {
+	if len(flagLocations)+len(flagCommands)+len(flagSyslog)+len(flagListen)+len(flagDocker)+len(flagJournal) > 0 && ac.config != "" {
 		return nil, errDualConfig
 	}
-	if len(flagLocations) < 1 && ac.config == "" {
+	if len(flagLocations)+len(flagCommands)+len(flagSyslog)+len(flagListen)+len(flagDocker)+len(flagJournal) < 1 && ac.config == "" {
 		return nil, errMustProvideConfig
 	}
 
@@ -41,13 +54,154 @@ func newConfigFromFlags() (*appConfig, error) {
 			return nil, err
 		}
 		ac.clearFilesOnClose = viper.GetBool("ClearLogsOnClose")
+		ac.clearing = clearing{
+			archiveDir: viper.GetString("ClearArchiveDir"),
+			compress:   viper.GetBool("ClearArchiveCompress"),
+			dryRun:     viper.GetBool("ClearDryRun"),
+		}
 		ac.logToFile = viper.GetString("LogToFile")
-		ac.locations = viper.GetStringSlice("Locations")
+		ac.diagnosticsFile = viper.GetString("DiagnosticsFile")
+		ac.timePrefix = viper.GetString("TimePrefix")
+		ac.outputFormat = formatText
+		if viper.IsSet("OutputFormat") {
+			ac.outputFormat = viper.GetString("OutputFormat")
+		}
+		if err := validateOutputFormat(ac.outputFormat); err != nil {
+			return nil, err
+		}
+		if ac.rotation, err = parseRotation(lowerKeys(viper.AllSettings())); err != nil {
+			return nil, err
+		}
+		ac.sinks = []sinkConfig{ac.defaultSink()}
+		if viper.IsSet("Sinks") {
+			if ac.sinks, err = parseSinkConfigs(viper.Get("Sinks")); err != nil {
+				return nil, err
+			}
+		}
+		ac.mergeWindow = viper.GetDuration("MergeWindow")
+		ac.stateFile = viper.GetString("StateFile")
+		ac.httpListen = viper.GetString("HTTPListen")
+		ac.retryUnavailable = viper.GetBool("RetryUnavailable")
+		ac.shutdownTimeout = defaultShutdownTimeout
+		if viper.IsSet("ShutdownTimeout") {
+			ac.shutdownTimeout = viper.GetDuration("ShutdownTimeout")
+		}
+		ac.historyLines = defaultHistoryLines
+		if viper.IsSet("HistoryLines") {
+			ac.historyLines = viper.GetInt("HistoryLines")
+		}
+		ac.historySize = defaultHistorySize
+		if viper.IsSet("HistorySize") {
+			if ac.historySize, err = parseSize(viper.GetString("HistorySize")); err != nil {
+				return nil, err
+			}
+		}
+		if ac.locations, err = configLocations(viper.AllSettings(), viper.Get("Locations")); err != nil {
+			return nil, err
+		}
 		return ac, nil
 	}
 	ac.clearFilesOnClose = flagClearFilesOnClose
+	ac.clearing = clearing{
+		archiveDir: flagClearArchiveDir,
+		compress:   flagClearArchiveCompress,
+		dryRun:     flagClearDryRun,
+	}
 	ac.logToFile = flagLogToFile
-	ac.locations = strings.Split(flagLocations[0], ",")
+	ac.diagnosticsFile = flagDiagnosticsFile
+	ac.timePrefix = flagTimePrefix
+	ac.outputFormat = flagOutputFormat
+	if err := validateOutputFormat(ac.outputFormat); err != nil {
+		return nil, err
+	}
+	defaults := location{options: tailOptions{
+		reOpen:    flagReOpen,
+		poll:      flagPoll,
+		mustExist: flagMustExist,
+		start:     flagStartAt,
+	}}
+	if err := validateStart(defaults.options.start); err != nil {
+		return nil, err
+	}
+	filter, err := newLineFilter(flagInclude, flagExclude, flagContains, flagNotContains)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.empty() {
+		defaults.filters = []*lineFilter{filter}
+	}
+	if defaults.minLevel, err = parseMinLevel(flagMinLevel); err != nil {
+		return nil, err
+	}
+	if defaults.timestamps, err = parseTimestampParser(map[string]interface{}{"timestamplayout": flagTimestampLayout}); err != nil {
+		return nil, err
+	}
+	if ac.rotation.maxSize, err = parseSize(flagRotateSize); err != nil {
+		return nil, err
+	}
+	ac.rotation.interval = flagRotateInterval
+	ac.rotation.keep = flagRotateKeep
+	ac.rotation.compress = flagRotateCompress
+	ac.sinks = []sinkConfig{ac.defaultSink()}
+	ac.mergeWindow = flagMergeWindow
+	ac.stateFile = flagStateFile
+	ac.httpListen = flagHTTPListen
+	ac.retryUnavailable = flagRetryUnavailable
+	ac.shutdownTimeout = flagShutdownTimeout
+	ac.historyLines = flagHistoryLines
+	if ac.historySize, err = parseSize(flagHistorySize); err != nil {
+		return nil, err
+	}
+	if len(flagLocations) > 0 {
+		for _, path := range strings.Split(flagLocations[0], ",") {
+			ac.locations = append(ac.locations, newLocation(path, defaults))
+		}
+	}
+	for _, line := range flagCommands {
+		l, err := parseCommandLocation(map[string]interface{}{"command": line, "restart": flagRestart}, defaults)
+		if err != nil {
+			return nil, err
+		}
+		ac.locations = append(ac.locations, l)
+	}
+	if err := checkCommands(ac.locations); err != nil {
+		return nil, err
+	}
+	for _, listen := range flagSyslog {
+		l, err := parseListenerLocation(locationSyslog, map[string]interface{}{"listen": listen}, defaults)
+		if err != nil {
+			return nil, err
+		}
+		ac.locations = append(ac.locations, l)
+	}
+	for _, listen := range flagListen {
+		l, err := parseListenerLocation(locationListen, map[string]interface{}{"listen": listen}, defaults)
+		if err != nil {
+			return nil, err
+		}
+		ac.locations = append(ac.locations, l)
+	}
+	if len(flagDocker) > 0 {
+		l, err := parseDockerSelectors(flagDocker, defaults)
+		if err != nil {
+			return nil, err
+		}
+		ac.locations = append(ac.locations, l)
+	}
+	if len(flagJournal) > 0 {
+		settings := map[string]interface{}{}
+		if units := []string(flagJournal); !(len(units) == 1 && units[0] == "all") {
+			settings["units"] = units
+		}
+		if flagJournalPriority != "" {
+			settings["priority"] = flagJournalPriority
+		}
+		l, err := parseJournalLocation(settings, defaults)
+		if err != nil {
+			return nil, err
+		}
+		ac.locations = append(ac.locations, l)
+	}
 	return ac, nil
 }
 
@@ -67,47 +221,82 @@ func readConfigFile(configPath string) error {
 	return nil
 }
 
+// configLocations parses the raw Locations value of a config file, settings
+// are all of the config file's settings, the top level ones are what each
+// location starts out with.
+func configLocations(settings map[string]interface{}, raw interface{}) ([]location, error) {
+	defaults, err := location{options: defaultTailOptions()}.configure(lowerKeys(settings))
+	if err != nil {
+		return nil, err
+	}
+	return parseLocations(raw, defaults)
+}
+
 // setLogOutput helps determine where we choose to log. Think 12 factor apps.
 // as in development on may want to stream to the console. Where as a log file
-// may be better elswhere. If a file is used for logging then said file
-// is casted to the logFile attribute of the calling appconfig.
+// may be better elswhere. Aggregated lines are written by the sinks, this only
+// concerns our own diagnostics (starting up, shutting down, errors), which are
+// kept apart from the aggregated lines. They go to stderr unless
+// diagnosticsFile is set, in which case said file is casted to the
+// diagnostics attribute of the calling appconfig.
 func (a *appConfig) setLogOutput() {
-	if a.logToFile != "" {
-		LogFile, err := os.OpenFile(a.logToFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-
+	if a.diagnosticsFile != "" {
+		f, err := os.OpenFile(a.diagnosticsFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		log.SetOutput(LogFile)
-		a.logFile = LogFile
+		log.SetOutput(f)
+		a.diagnostics = f
 	}
 }
 
-// clearFiles as the name suggests will locate all of the log files within
-// the locations argument - and write all of the bytes to be empty. This is
-// intended to be used per the users settings and can be handy in development.
-// chose not to return the error here has it is only called on the control c /
-// upon the program closing.
-func (a *appConfig) clearFiles() {
-	for _, l := range a.locations {
-		err := ioutil.WriteFile(l, []byte{}, 0666)
-		if err != nil {
-			log.Println("Unable to clear file at location:", l)
-			log.Println(err)
-		}
+// reopenDiagnostics reopens the diagnostics file, so our own messages go to
+// a new file once the old one was moved aside.
+func (a *appConfig) reopenDiagnostics() {
+	if a.diagnosticsFile == "" {
+		return
+	}
+	f, err := os.OpenFile(a.diagnosticsFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Println("Unable to reopen the diagnostics file:", err)
+		return
 	}
+	log.SetOutput(f)
+	a.diagnostics.Close()
+	a.diagnostics = f
 }
 
-// shutdown per the values witin the calling appConfig will close the logging
-// file or attempt to clear the files the app is polling from.
-func (a *appConfig) shutdown() {
-	if a.clearFilesOnClose {
-		log.Println("Attempting to clear log files...")
-		a.clearFiles()
+// defaultSink is the sink used when the config file does not list any Sinks.
+// It writes to stdout, or to logToFile when it is set, rotating it per the
+// top level rotation settings.
+func (a *appConfig) defaultSink() sinkConfig {
+	c := sinkConfig{kind: sinkStdout, format: a.outputFormat, timePrefix: a.timePrefix, buffer: defaultSinkBuffer, rotation: a.rotation}
+	if a.logToFile != "" {
+		c.kind = sinkFile
+		c.path = a.logToFile
 	}
+	return c
+}
 
-	if a.logToFile != "" {
-		a.logFile.Close()
+// clearFiles as the name suggests will clear the log files of the sources
+// that were stopped, per the users settings, which can be handy in
+// development. Only what we read from each file is cleared, lines written to
+// it after we stopped are kept. chose not to return the error here has it is
+// only called on the control c / upon the program closing.
+func (a *appConfig) clearFiles(sources []*source) {
+	if !a.clearFilesOnClose && !a.clearing.dryRun {
+		return
+	}
+	log.Println("Attempting to clear log files...")
+	clearSources(sources, a.clearing)
+}
+
+// shutdown per the values witin the calling appConfig will close the
+// diagnostics file.
+func (a *appConfig) shutdown() {
+	if a.diagnosticsFile != "" {
+		log.SetOutput(os.Stderr)
+		a.diagnostics.Close()
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+// controls are what the signals that do not stop us act on.
+type controls struct {
+	appConfig *appConfig
+	tails     *tailSet
+	sinks     *sinkSet
+	reloader  *configReloader
+}
+
+// hangup reopens the files we write to, so we follow along when they are
+// rotated by someone else such as logrotate, and reloads the config file.
+func (c controls) hangup() {
+	log.Println("Reopening output files...")
+	c.appConfig.reopenDiagnostics()
+	c.sinks.reopen()
+	if c.reloader != nil {
+		c.reloader.reload()
+	}
+}
+
+// status logs how far along every source is, and what the lossy sinks have
+// dropped.
+func (c controls) status() {
+	sources := c.tails.list()
+	sort.Slice(sources, func(i, j int) bool { return sources[i].path < sources[j].path })
+	pending := c.tails.unavailable()
+	log.Println("Aggregating", len(sources), "sources,", len(pending), "log files unavailable")
+	for _, s := range sources {
+		log.Println(s.status())
+	}
+	for _, p := range pending {
+		log.Println(p.status())
+	}
+	c.sinks.status()
+}
+
+// status describes how far into its file the source has read, how many lines
+// it has read and when it last read one.
+func (s *source) status() string {
+	if !s.isFile() {
+		return fmt.Sprintf("[%s] %s: read %d bytes, %d lines, %s", s.label, s.path, s.consumed(), atomic.LoadInt64(&s.count), s.lastLine())
+	}
+	read := "an unknown number of"
+	if offset := s.consumed(); offset >= 0 {
+		read = fmt.Sprint(offset)
+	}
+	size := "?"
+	if fi, err := os.Stat(s.path); err == nil {
+		size = fmt.Sprint(fi.Size())
+	}
+	return fmt.Sprintf("[%s] %s: read %s of %s bytes, %d lines, %s", s.label, s.path, read, size, atomic.LoadInt64(&s.count), s.lastLine())
+}
+
+// lastLine describes when the source last read a line.
+func (s *source) lastLine() string {
+	nano := atomic.LoadInt64(&s.lastRead)
+	if nano == 0 {
+		return "no lines read yet"
+	}
+	return fmt.Sprintf("last line read %s ago", time.Since(time.Unix(0, nano)).Round(time.Second))
+}
+
+// drainOrExit gives shutting down timeout to finish, exiting once it takes
+// any longer or when we are asked to stop a second time. A timeout of 0 or
+// less means there is no limit.
+func drainOrExit(timeout time.Duration) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	go func() {
+		select {
+		case <-expired:
+			log.Println("Gave up waiting for aggregator to shut down after", timeout)
+		case <-closingChannel:
+			log.Println("Stopping without waiting for aggregator to shut down")
+		}
+		os.Exit(1)
+	}()
+}
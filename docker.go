@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/spf13/cast"
+)
+
+const (
+	// locationDocker is the Type of the entries under Locations that follow
+	// the logs of docker containers.
+	locationDocker = "docker"
+
+	defaultDockerSocket = "/var/run/docker.sock"
+
+	// composeProjectLabel is the label docker compose puts the name of the
+	// project on each of its containers under.
+	composeProjectLabel = "com.docker.compose.project"
+
+	// dockerHeaderSize is the size of the header in front of each frame of a
+	// container's logs, when it has no tty.
+	dockerHeaderSize = 8
+)
+
+var (
+	errInvalidDockerSelector = errors.New("a docker container must be chosen by a name, project=NAME, label=KEY=VALUE or all")
+	errDockerResponse        = errors.New("unexpected response from docker")
+)
+
+// dockerSpec chooses the containers whose logs are followed. A container has
+// to have one of the names, when there are any, and every one of the labels.
+// A project adds the label docker compose puts on the containers of that
+// project. The labels of the containers' sources are put behind prefix,
+// when it is set.
+type dockerSpec struct {
+	socket string
+	names  []string
+	labels []string
+	prefix string
+}
+
+// parseDockerLocation reads an entry of Locations with a Type of docker.
+// Containers, Labels and Project choose the containers, which are all of
+// them when none are set. Socket defaults to the socket of DOCKER_HOST, or
+// /var/run/docker.sock. Label is put in front of the labels of the
+// containers when it is set.
+func parseDockerLocation(settings map[string]interface{}, defaults location) (location, error) {
+	spec := &dockerSpec{
+		socket: cast.ToString(settings["socket"]),
+		names:  toStrings(settings["containers"]),
+		labels: toStrings(settings["labels"]),
+		prefix: cast.ToString(settings["label"]),
+	}
+	if project := cast.ToString(settings["project"]); project != "" {
+		spec.labels = append(spec.labels, composeProjectLabel+"="+project)
+	}
+	if spec.socket == "" {
+		spec.socket = dockerSocket()
+	}
+
+	l := defaults
+	l.path = "docker:" + spec.String()
+	l.label = spec.prefix
+	if l.label == "" {
+		l.label = locationDocker
+	}
+	l.docker = spec
+	return l, nil
+}
+
+// parseDockerSelectors builds the dockerSpec of the -docker flag, each of the
+// selectors is the name of a container, project=NAME, label=KEY=VALUE or all.
+func parseDockerSelectors(selectors []string, defaults location) (location, error) {
+	settings := map[string]interface{}{}
+	var names, labels []string
+	for _, s := range selectors {
+		switch {
+		case s == "all":
+		case strings.HasPrefix(s, "project="):
+			labels = append(labels, composeProjectLabel+"="+strings.TrimPrefix(s, "project="))
+		case strings.HasPrefix(s, "label="):
+			labels = append(labels, strings.TrimPrefix(s, "label="))
+		case s != "" && !strings.Contains(s, "="):
+			names = append(names, s)
+		default:
+			return location{}, errInvalidDockerSelector
+		}
+	}
+	settings["containers"] = names
+	settings["labels"] = labels
+	return parseDockerLocation(settings, defaults)
+}
+
+// dockerSocket returns the socket of DOCKER_HOST when it is a unix socket,
+// and the default socket otherwise.
+func dockerSocket() string {
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// String describes the containers the spec chooses, it is what the path of
+// its location is made of.
+func (spec *dockerSpec) String() string {
+	var parts []string
+	for _, n := range spec.names {
+		parts = append(parts, "name="+n)
+	}
+	for _, l := range spec.labels {
+		parts = append(parts, "label="+l)
+	}
+	sort.Strings(parts)
+	if len(parts) == 0 {
+		parts = []string{"all"}
+	}
+	return strings.Join(parts, ",")
+}
+
+// filters returns the filters docker's api chooses the spec's containers by.
+func (spec *dockerSpec) filters(id string) string {
+	f := map[string][]string{}
+	if len(spec.names) > 0 {
+		f["name"] = spec.names
+	}
+	if len(spec.labels) > 0 {
+		f["label"] = spec.labels
+	}
+	if id != "" {
+		f["id"] = []string{id}
+	}
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+// startDocker starts following the logs of the containers the location
+// chooses, adding a source for it. The logs go to the sources of each of the
+// containers. Callers hold the lock.
+func (ts *tailSet) startDocker(l location) error {
+	dw, err := watchDocker(l, ts)
+	if err != nil {
+		return err
+	}
+	ts.startSource(&source{location: l, lines: dw.lines, stop: dw.stop})
+	return nil
+}
+
+// dockerWatcher follows the logs of every container its location chooses,
+// attaching to the ones that start later on as well.
+type dockerWatcher struct {
+	location
+	tails    *tailSet
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lines    chan *tail.Line
+	quit     chan struct{}
+	mu       sync.Mutex
+	attached map[string]url.Values
+	lastRead map[string]time.Time
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// dockerContainer is a container as it is listed by docker's api.
+type dockerContainer struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+}
+
+// name returns the name of the container, without the slash docker puts in
+// front of it, or the short form of its id when it has no name.
+func (c dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		if len(c.ID) > 12 {
+			return c.ID[:12]
+		}
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// dockerEvent is an event from docker's api.
+type dockerEvent struct {
+	ID       string `json:"id"`
+	Action   string `json:"Action"`
+	TimeNano int64  `json:"timeNano"`
+}
+
+// watchDocker makes sure docker answers on the location's socket, and starts
+// following the logs of the containers the location chooses.
+func watchDocker(l location, tails *tailSet) (*dockerWatcher, error) {
+	socket := l.docker.socket
+	dw := &dockerWatcher{
+		location: l,
+		tails:    tails,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}},
+		lines:    make(chan *tail.Line),
+		quit:     make(chan struct{}),
+		attached: make(map[string]url.Values),
+		lastRead: make(map[string]time.Time),
+	}
+	dw.ctx, dw.cancel = context.WithCancel(context.Background())
+
+	resp, err := dw.get(dw.ctx, "/_ping", nil)
+	if err != nil {
+		dw.cancel()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	log.Println("Following the logs of the docker containers chosen by:", l.docker)
+	dw.wg.Add(1)
+	go dw.run()
+	go func() {
+		dw.wg.Wait()
+		close(dw.lines)
+	}()
+	return dw, nil
+}
+
+// get requests the path from docker's api, returning an error for anything
+// but a 200. The request is cancelled along with ctx.
+func (dw *dockerWatcher) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dw.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", errDockerResponse, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+// run attaches to the containers that are running and to the ones that start
+// later on, until the watcher is stopped. Events are subscribed to before
+// listing the containers, so a container starting in between is not missed.
+// When docker goes away the watcher reconnects, backing off as the retries
+// of unavailable files do.
+func (dw *dockerWatcher) run() {
+	defer dw.wg.Done()
+	backoff := retryMinBackoff
+	first := true
+	for {
+		err := dw.follow(first)
+		if dw.isStopped() {
+			return
+		}
+		log.Println("Lost the connection to docker at", dw.docker.socket, err)
+		select {
+		case <-time.After(backoff):
+		case <-dw.quit:
+			return
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+		first = false
+	}
+}
+
+// follow attaches to the containers that are running, and then to each
+// container that starts, until the events from docker end. On the first
+// call, the location's StartAt decides how much of the logs of the running
+// containers is read, after reconnecting their logs are resumed.
+func (dw *dockerWatcher) follow(first bool) error {
+	resp, err := dw.get(dw.ctx, "/events", url.Values{
+		"filters": {`{"type":["container"],"event":["start"]}`},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	containers, err := dw.list("")
+	if err != nil {
+		return err
+	}
+	if !first {
+		dw.forgetStopped(containers)
+	}
+	for _, c := range containers {
+		query := url.Values{}
+		if first {
+			query = dw.startQuery()
+		}
+		dw.attach(c, query)
+	}
+
+	d := json.NewDecoder(resp.Body)
+	for {
+		var e dockerEvent
+		if err := d.Decode(&e); err != nil {
+			return err
+		}
+		if e.Action != "start" {
+			continue
+		}
+		containers, err := dw.list(e.ID)
+		if err != nil {
+			log.Println("Unable to look up docker container", e.ID, err)
+			continue
+		}
+		for _, c := range containers {
+			// Only the logs written since it started, a container that
+			// was restarted has the logs of its earlier runs as well.
+			dw.attach(c, url.Values{"since": {dockerTime(time.Unix(0, e.TimeNano))}})
+		}
+	}
+}
+
+// resume returns the query, unless it is empty, which asks to carry on with
+// the logs of a container after reconnecting to docker: from when they were
+// last read, or all of them for a container that started while docker was
+// away. Callers hold the lock.
+func (dw *dockerWatcher) resume(id string, query url.Values) url.Values {
+	if len(query) > 0 {
+		return query
+	}
+	if t, ok := dw.lastRead[id]; ok {
+		return url.Values{"since": {dockerTime(t)}}
+	}
+	return url.Values{"tail": {"all"}}
+}
+
+// forgetStopped forgets when the logs were last read of the containers that
+// are no longer running, when they start again they are attached to with the
+// time they started.
+func (dw *dockerWatcher) forgetStopped(running []dockerContainer) {
+	ids := make(map[string]bool, len(running))
+	for _, c := range running {
+		ids[c.ID] = true
+	}
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	for id := range dw.lastRead {
+		if !ids[id] {
+			delete(dw.lastRead, id)
+		}
+	}
+}
+
+// dockerTime formats t the way docker's api takes a since.
+func dockerTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// startQuery returns how much of the logs to read per the location's
+// StartAt.
+func (dw *dockerWatcher) startQuery() url.Values {
+	switch dw.options.start {
+	case startBeginning:
+		return url.Values{"tail": {"all"}}
+	case startEnd:
+		return url.Values{"tail": {"0"}}
+	}
+	return url.Values{"tail": {dw.options.start}}
+}
+
+// list returns the running containers the location chooses, only the one
+// with the id when it is set.
+func (dw *dockerWatcher) list(id string) ([]dockerContainer, error) {
+	resp, err := dw.get(dw.ctx, "/containers/json", url.Values{"filters": {dw.docker.filters(id)}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	return containers, json.NewDecoder(resp.Body).Decode(&containers)
+}
+
+// attach follows the logs of the container, adding a source for its stdout
+// and one for its stderr. When its logs are being followed already, as when
+// it was restarted before the logs of its last run ended or when the
+// connection to docker was lost before they noticed, they are followed again
+// with the query once they do.
+func (dw *dockerWatcher) attach(c dockerContainer, query url.Values) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.isStopped() {
+		return
+	}
+	if _, ok := dw.attached[c.ID]; ok {
+		dw.attached[c.ID] = query
+		return
+	}
+	dw.attached[c.ID] = nil
+	query = dw.resume(c.ID, query)
+	dw.wg.Add(1)
+
+	go func() {
+		defer dw.wg.Done()
+		for {
+			if err := dw.followLogs(c, query); err != nil && !dw.isStopped() {
+				log.Println("Unable to follow the logs of docker container", c.name(), err)
+			}
+
+			dw.mu.Lock()
+			query = dw.attached[c.ID]
+			if query == nil || dw.isStopped() {
+				delete(dw.attached, c.ID)
+				dw.mu.Unlock()
+				return
+			}
+			dw.attached[c.ID] = nil
+			query = dw.resume(c.ID, query)
+			dw.mu.Unlock()
+		}
+	}()
+}
+
+// followLogs reads the logs of the container until it stops, or until its
+// sources are stopped.
+func (dw *dockerWatcher) followLogs(c dockerContainer, query url.Values) error {
+	resp, err := dw.get(dw.ctx, "/containers/"+c.ID+"/json", nil)
+	if err != nil {
+		return err
+	}
+	var inspect struct {
+		Config struct {
+			Tty bool
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&inspect)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(dw.ctx)
+	defer cancel()
+	query.Set("follow", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	resp, err = dw.get(ctx, "/containers/"+c.ID+"/logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	stdout, stdoutDone := dw.openStream(c, "stdout", cancel)
+	if stdout == nil {
+		return nil
+	}
+	stderr, stderrDone := dw.openStream(c, "stderr", cancel)
+	if stderr == nil {
+		stdout.Close()
+		<-stdoutDone
+		return nil
+	}
+	log.Println("Following the logs of docker container", c.name())
+
+	body := &readTimer{r: resp.Body}
+	if inspect.Config.Tty {
+		_, err = io.Copy(stdout, body)
+	} else {
+		err = demuxDockerLogs(body, stdout, stderr)
+	}
+	if !body.last.IsZero() {
+		dw.mu.Lock()
+		dw.lastRead[c.ID] = body.last
+		dw.mu.Unlock()
+	}
+	stdout.Close()
+	stderr.Close()
+	<-stdoutDone
+	<-stderrDone
+	if err == nil || err == io.EOF || dw.isStopped() || ctx.Err() != nil {
+		log.Println("Stopped following the logs of docker container", c.name())
+		return nil
+	}
+	return err
+}
+
+// readTimer records when something was last read from r.
+type readTimer struct {
+	r    io.Reader
+	last time.Time
+}
+
+func (rt *readTimer) Read(p []byte) (int, error) {
+	n, err := rt.r.Read(p)
+	if n > 0 {
+		rt.last = time.Now()
+	}
+	return n, err
+}
+
+// openStream adds the source of one of the container's streams, labeled by
+// the container's name and the name of the stream. What is written to the
+// pipe it returns is read line by line, done is closed once the pipe is
+// closed and its lines were handed to the source. A nil pipe is returned when
+// the watcher was stopped in the meantime.
+func (dw *dockerWatcher) openStream(c dockerContainer, stream string, stop func()) (*io.PipeWriter, <-chan struct{}) {
+	l := dw.location
+	sep := string(filepath.Separator)
+	l.path = dw.path + sep + c.name() + sep + stream
+	l.label = c.name() + "/" + stream
+	if dw.docker.prefix != "" {
+		l.label = dw.docker.prefix + "/" + l.label
+	}
+
+	lines := make(chan *tail.Line)
+	s := &source{location: l, lines: lines, stop: stop}
+	if !dw.tails.addChild(dw.quit, s) {
+		return nil, nil
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go readLines(pr, lines, func() {
+		close(lines)
+		dw.tails.dropChild(s)
+		close(done)
+	})
+	return pw, done
+}
+
+// demuxDockerLogs splits the logs of a container without a tty, which docker
+// sends as frames, each with a header telling whether it came from stdout or
+// stderr and how long it is.
+func demuxDockerLogs(r io.Reader, stdout, stderr io.Writer) error {
+	br := bufio.NewReader(r)
+	var header [dockerHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, br, size); err != nil {
+			return err
+		}
+	}
+}
+
+func (dw *dockerWatcher) isStopped() bool {
+	select {
+	case <-dw.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops following the logs of every container, without waiting for
+// their sources, which remove themselves from the tailSet. It is safe to call
+// more than once.
+func (dw *dockerWatcher) stop() {
+	dw.stopOnce.Do(func() {
+		dw.mu.Lock()
+		close(dw.quit)
+		dw.mu.Unlock()
+		dw.cancel()
+	})
+}
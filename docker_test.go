@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dockerFrame returns a frame of a container's logs as docker sends them when
+// the container has no tty.
+func dockerFrame(stream byte, text string) []byte {
+	frame := make([]byte, dockerHeaderSize, dockerHeaderSize+len(text))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(text)))
+	return append(frame, text...)
+}
+
+// chunkReader returns its data a few bytes at a time, so frames are split
+// across reads.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDemuxDockerLogs(t *testing.T) {
+	frames := func(fs ...[]byte) []byte { return bytes.Join(fs, nil) }
+	tests := []struct {
+		name   string
+		input  []byte
+		chunk  int
+		stdout string
+		stderr string
+		err    error
+	}{
+		{
+			name:  "empty",
+			input: nil,
+			err:   io.EOF,
+		},
+		{
+			name:   "stdout and stderr",
+			input:  frames(dockerFrame(1, "out 1\n"), dockerFrame(2, "err 1\n"), dockerFrame(1, "out 2\n")),
+			stdout: "out 1\nout 2\n",
+			stderr: "err 1\n",
+			err:    io.EOF,
+		},
+		{
+			name:   "frames split across reads",
+			input:  frames(dockerFrame(1, "a line\n"), dockerFrame(2, "another line\n")),
+			chunk:  3,
+			stdout: "a line\n",
+			stderr: "another line\n",
+			err:    io.EOF,
+		},
+		{
+			name:   "line split across frames",
+			input:  frames(dockerFrame(1, "half a "), dockerFrame(1, "line\n")),
+			stdout: "half a line\n",
+			err:    io.EOF,
+		},
+		{
+			name:   "empty frame",
+			input:  frames(dockerFrame(1, ""), dockerFrame(1, "after\n")),
+			stdout: "after\n",
+			err:    io.EOF,
+		},
+		{
+			name:  "truncated header",
+			input: dockerFrame(1, "x")[:5],
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated frame",
+			input:  dockerFrame(2, "cut short\n")[:dockerHeaderSize+3],
+			stderr: "cut",
+			err:    io.EOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(test.input)
+			if test.chunk > 0 {
+				r = &chunkReader{data: test.input, size: test.chunk}
+			}
+			var stdout, stderr bytes.Buffer
+			err := demuxDockerLogs(r, &stdout, &stderr)
+			if err != test.err {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+			if stdout.String() != test.stdout {
+				t.Errorf("got stdout %q, want %q", stdout.String(), test.stdout)
+			}
+			if stderr.String() != test.stderr {
+				t.Errorf("got stderr %q, want %q", stderr.String(), test.stderr)
+			}
+		})
+	}
+}
+
+// eventChan is an eventOutput that hands every event to a channel.
+type eventChan chan *event
+
+func (c eventChan) write(s *source, e *event) {
+	c <- e
+}
+
+// next returns the next event, failing the test when none comes in time.
+func (c eventChan) next(t *testing.T) *event {
+	t.Helper()
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+// followedLogs serves the logs of a container that is followed from the
+// beginning, and keeps the request open until the client goes away.
+func followedLogs(logs []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("follow") != "1" || r.URL.Query().Get("tail") != "all" {
+			http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Write(logs)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+// fakeDocker serves the parts of docker's api the dockerWatcher uses on a unix
+// socket, with a single container named web that has no tty and whose logs
+// are served by logs. Events are sent until events is closed, when it is
+// not nil, and the connection is dropped then.
+func fakeDocker(t *testing.T, logs http.HandlerFunc, events chan struct{}) (socket string, closer func()) {
+	dir, err := ioutil.TempDir("", "aggregator-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket = filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-events:
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Id":"0123456789abcdef","Names":["/web"]}]`)
+	})
+	mux.HandleFunc("/containers/0123456789abcdef/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Config":{"Tty":false}}`)
+	})
+	mux.HandleFunc("/containers/0123456789abcdef/logs", logs)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = ln
+	server.Start()
+	return socket, func() {
+		server.CloseClientConnections()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDockerWatcherFollowsLogs(t *testing.T) {
+	logs := bytes.Join([][]byte{
+		dockerFrame(1, "listening on :80\n"),
+		dockerFrame(2, "no config, "),
+		dockerFrame(2, "using defaults\n"),
+	}, nil)
+	socket, closer := fakeDocker(t, followedLogs(logs), nil)
+	defer closer()
+
+	l, err := parseDockerLocation(map[string]interface{}{"socket": socket}, location{options: defaultTailOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(eventChan, 10)
+	ts := newTailSet(events, nil, false)
+	if err := ts.add(l); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.stopAll()
+
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		e := events.next(t)
+		got[e.Label] = e.Text
+	}
+	want := map[string]string{
+		"web/stdout": "listening on :80",
+		"web/stderr": "no config, using defaults",
+	}
+	for label, text := range want {
+		if got[label] != text {
+			t.Errorf("got %q from %s, want %q", got[label], label, text)
+		}
+	}
+}
+
+func TestDockerWatcherUnavailable(t *testing.T) {
+	socket, closer := fakeDocker(t, followedLogs(nil), nil)
+	closer()
+
+	l, err := parseDockerLocation(map[string]interface{}{"socket": socket}, location{options: defaultTailOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTailSet(make(eventChan), nil, false)
+	if err := ts.add(l); err == nil {
+		ts.stopAll()
+		t.Fatal("expected an error when docker is not listening")
+	}
+}
+
+func TestDockerWatcherResumesAfterReconnecting(t *testing.T) {
+	events := make(chan struct{})
+	queries := make(chan url.Values, 2)
+	logs := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queries <- query
+		if query.Get("tail") == "all" {
+			w.Write(dockerFrame(1, "before\n"))
+			return
+		}
+		w.Write(dockerFrame(1, "after\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+	socket, closer := fakeDocker(t, logs, events)
+	defer closer()
+
+	l, err := parseDockerLocation(map[string]interface{}{"socket": socket}, location{options: defaultTailOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.options.start = startBeginning
+	out := make(eventChan, 10)
+	ts := newTailSet(out, nil, false)
+	if err := ts.add(l); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.stopAll()
+
+	if e := out.next(t); e.Text != "before" {
+		t.Fatalf("got %q, want before", e.Text)
+	}
+	close(events)
+	if e := out.next(t); e.Text != "after" {
+		t.Fatalf("got %q after reconnecting, want after", e.Text)
+	}
+
+	<-queries
+	query := <-queries
+	if query.Get("tail") != "" || query.Get("since") == "" {
+		t.Errorf("resumed with %s, want a since and no tail", query.Encode())
+	}
+}
+
+func TestDockerContainerName(t *testing.T) {
+	tests := []struct {
+		container dockerContainer
+		name      string
+	}{
+		{dockerContainer{ID: "0123456789abcdef", Names: []string{"/web"}}, "web"},
+		{dockerContainer{ID: "0123456789abcdef"}, "0123456789ab"},
+		{dockerContainer{ID: "0123"}, "0123"},
+	}
+	for _, test := range tests {
+		if name := test.container.name(); name != test.name {
+			t.Errorf("got %q for %+v, want %q", name, test.container, test.name)
+		}
+	}
+}
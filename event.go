@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+var (
+	errInvalidOutputFormat = errors.New("the output format must either be text or json")
+
+	// hostname is added to every event so aggregated output from several
+	// machines can be told apart.
+	hostname, _ = os.Hostname()
+)
+
+// event is a single entry read from a source, a line or a group of lines when
+// the source has a multiline rule. The json tags are the field names used by
+// the json output format.
+type event struct {
+	Source    string                 `json:"source"`
+	Label     string                 `json:"label"`
+	Text      string                 `json:"line"`
+	Received  time.Time              `json:"received"`
+	Timestamp time.Time              `json:"timestamp"`
+	Late      bool                   `json:"late,omitempty"`
+	Offset    int64                  `json:"offset"`
+	Host      string                 `json:"host"`
+	Level     level                  `json:"level,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// readEvents turns the lines of the source's tail into events. The offset is
+// where the line ends in the file. When the source has a parser, lines
+// it understands are replaced by their rendered form and their fields are
+// kept on the event. The level and the time the line was logged at are read
+// from the line as it was read, falling back to when we received the line.
+func readEvents(s *source) <-chan *event {
+	events := make(chan *event)
+	go func() {
+		defer close(events)
+		for line := range s.lines {
+			offset, left, at := s.advance(line.Text)
+			for _, text := range left {
+				at += int64(len(text)) + 1
+				events <- s.newEvent(text, line.Time, at)
+			}
+			events <- s.newEvent(line.Text, line.Time, offset)
+		}
+	}()
+	return events
+}
+
+// newEvent returns the event of a line of the source that ends at offset.
+func (s *source) newEvent(line string, received time.Time, offset int64) *event {
+	e := &event{
+		Source:   s.path,
+		Label:    s.label,
+		Text:     line,
+		Received: received,
+		Offset:   offset,
+		Host:     hostname,
+	}
+	switch {
+	case s.isSyslog():
+		readSyslogEvent(s, e)
+		return e
+	case s.isJournal():
+		readJournalEvent(s, e)
+		return e
+	}
+	fields, text, ok := s.parser.parse(line)
+	if ok {
+		e.Fields = fields
+		e.Text = text
+	}
+	e.Level = detectLevel(s.levelPatterns, e.Fields, line)
+	if e.Timestamp, ok = s.timestamps.parse(line); !ok {
+		e.Timestamp = e.Received
+	}
+	return e
+}
+
+// readSyslogEvent fills in the event from the syslog message in its text. The
+// level, timestamp and host come from the message's header when it has
+// them, the rest of the header is kept in the event's fields. The source's
+// parser is applied to the message itself.
+func readSyslogEvent(s *source, e *event) {
+	m, ok := parseSyslog(e.Text, e.Received)
+	if !ok {
+		e.Level = detectLevel(s.levelPatterns, nil, e.Text)
+		e.Timestamp = e.Received
+		return
+	}
+
+	e.Fields, m.message, _ = s.parser.parse(m.message)
+	e.Fields = m.fields(e.Fields)
+	e.Text = m.text()
+	e.Level = m.level()
+	e.Timestamp = m.timestamp
+	if e.Timestamp.IsZero() {
+		e.Timestamp = e.Received
+	}
+	if m.hostname != "" {
+		e.Host = m.hostname
+	}
+}
+
+// validateOutputFormat makes sure the format is one eventWriter knows about.
+func validateOutputFormat(format string) error {
+	if format != formatText && format != formatJSON {
+		return errInvalidOutputFormat
+	}
+	return nil
+}
+
+// eventWriter writes the events of every source to the aggregated output. It
+// is kept apart from the standard logger, which is used for our own
+// diagnostics. In the text format events are prefixed with their source's
+// label, and the time they were received at when timePrefix holds a layout,
+// and are colored by their level when writing to a terminal. In the json
+// format each event is written as a single json object per line without any
+// prefix, so the output can be fed to jq.
+type eventWriter struct {
+	mu         sync.Mutex
+	out        io.Writer
+	format     string
+	colorize   bool
+	timePrefix string
+}
+
+// write formats the event and writes it out in a single write.
+func (w *eventWriter) write(s *source, e *event) error {
+	b, err := w.formatEvent(s, e)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.out.Write(b)
+	return err
+}
+
+// writeRaw writes events that were already formatted.
+func (w *eventWriter) writeRaw(b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(b)
+	return err
+}
+
+// formatEvent returns the event as it is written out, including the trailing
+// newline.
+func (w *eventWriter) formatEvent(s *source, e *event) ([]byte, error) {
+	if w.format == formatJSON {
+		b, err := json.Marshal(e)
+		return append(b, '\n'), err
+	}
+
+	var b bytes.Buffer
+	if w.timePrefix != "" {
+		b.WriteString(e.Received.Format(w.timePrefix))
+		b.WriteByte(' ')
+	}
+	b.WriteString(s.prefix(w.colorize))
+	if e.Late {
+		b.WriteString("(late) ")
+	}
+	if w.colorize {
+		b.WriteString(colorizeLevel(e.Level, e.Text))
+	} else {
+		b.WriteString(e.Text)
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/cast"
+)
+
+// lineFilter decides which lines make it to the output. A line is allowed
+// when it matches at least one of the include expressions (or there are
+// none), and does not match any of the exclude expressions.
+type lineFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newLineFilter compiles the include and exclude regular expressions. The
+// contains and notContains values are plain substrings that are matched
+// without regard to case, they are a shortcut for the common case of
+// keeping or dropping lines that mention a word.
+func newLineFilter(include, exclude, contains, notContains []string) (*lineFilter, error) {
+	f := &lineFilter{}
+	var err error
+	if f.include, err = compileAll(include, false); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileAll(exclude, false); err != nil {
+		return nil, err
+	}
+	substrings, err := compileAll(contains, true)
+	if err != nil {
+		return nil, err
+	}
+	f.include = append(f.include, substrings...)
+	if substrings, err = compileAll(notContains, true); err != nil {
+		return nil, err
+	}
+	f.exclude = append(f.exclude, substrings...)
+	return f, nil
+}
+
+// parseLineFilter builds a lineFilter from the Include, Exclude, Contains and
+// NotContains keys within settings, each of which can be a single string or a
+// list of them. The keys are expected to be lowercased already.
+func parseLineFilter(settings map[string]interface{}) (*lineFilter, error) {
+	return newLineFilter(
+		toStrings(settings["include"]),
+		toStrings(settings["exclude"]),
+		toStrings(settings["contains"]),
+		toStrings(settings["notcontains"]),
+	)
+}
+
+// allows reports whether the line passes the filter.
+func (f *lineFilter) allows(text string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(text) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// empty reports whether the filter would let every line through.
+func (f *lineFilter) empty() bool {
+	return f == nil || len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// compileAll compiles each expression, when literal is set the expressions
+// are treated as case insensitive substrings rather than regular expressions.
+func compileAll(expressions []string, literal bool) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, e := range expressions {
+		if literal {
+			e = "(?i)" + regexp.QuoteMeta(e)
+		}
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// toStrings turns a config value that is either a single string or a list
+// into a slice of strings. Unlike cast.ToStringSlice a single string is not
+// split on whitespace, as regular expressions may well contain spaces.
+func toStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			s = append(s, cast.ToString(e))
+		}
+		return s
+	}
+	return cast.ToStringSlice(v)
+}
+
+// eventFilter picks the events an output is interested in. Sources holds the
+// labels or paths (patterns are allowed) of the locations it wants, all of
+// them when it is empty. Events below minLevel, or not making it through the
+// filters, are left out.
+type eventFilter struct {
+	sources  []string
+	filters  []*lineFilter
+	minLevel level
+}
+
+// wants reports whether the event passes the filter.
+func (f eventFilter) wants(src *source, e *event) bool {
+	if len(f.sources) > 0 && !matchesAny(f.sources, src) {
+		return false
+	}
+	if f.minLevel != levelUnknown && e.Level < f.minLevel {
+		return false
+	}
+	for _, lf := range f.filters {
+		if !lf.allows(e.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether the source's label or path matches one of the
+// patterns.
+func matchesAny(patterns []string, src *source) bool {
+	for _, p := range patterns {
+		if p == src.label || p == src.path {
+			return true
+		}
+		if ok, _ := filepath.Match(p, src.label); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, src.path); ok {
+			return true
+		}
+	}
+	return false
+}
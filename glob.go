@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// globPattern is a location whose path contains wildcards. The root is the
+// part of the path in front of the first wildcard, it is the directory we
+// walk and watch for files that match the remaining segments.
+type globPattern struct {
+	location
+	root     string
+	segments []string
+}
+
+// hasMeta reports whether the path contains any of the characters that
+// filepath.Match treats as special.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// isDir reports whether the path exists and is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// splitLocations seperates the locations that point to a single file from the
+// ones that need to be expanded. A directory is treated as if the user asked
+// for every file directly within it. Commands and stdin are kept with the
+// files.
+func splitLocations(locations []location) (files []location, patterns []globPattern) {
+	for _, l := range locations {
+		switch {
+		case l.isStream():
+			files = append(files, l)
+		case hasMeta(l.path):
+			patterns = append(patterns, newGlobPattern(l))
+		case isDir(l.path):
+			l.path = filepath.Join(l.path, "*")
+			patterns = append(patterns, newGlobPattern(l))
+		default:
+			files = append(files, l)
+		}
+	}
+	return files, patterns
+}
+
+// newGlobPattern splits the location's path into the directory in front of
+// the first wildcard and the segments that follow it.
+func newGlobPattern(l location) globPattern {
+	sep := string(filepath.Separator)
+	parts := strings.Split(filepath.Clean(l.path), sep)
+
+	i := 0
+	for i < len(parts) && !hasMeta(parts[i]) {
+		i++
+	}
+
+	root := strings.Join(parts[:i], sep)
+	switch {
+	case root == "" && filepath.IsAbs(l.path):
+		root = sep
+	case root == "":
+		root = "."
+	}
+	return globPattern{location: l, root: root, segments: parts[i:]}
+}
+
+// relSegments returns the segments of path relative to the pattern's root, ok
+// is false when the path lives outside of the root.
+func (g globPattern) relSegments(path string) ([]string, bool) {
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, false
+	}
+	if rel == "." {
+		return nil, true
+	}
+	return strings.Split(rel, string(filepath.Separator)), true
+}
+
+// matches reports whether the file at path is one the pattern asks for.
+func (g globPattern) matches(path string) bool {
+	rel, ok := g.relSegments(path)
+	return ok && matchSegments(g.segments, rel)
+}
+
+// mayContain reports whether the directory at path could hold files that the
+// pattern matches, this is what decides which directories we watch.
+func (g globPattern) mayContain(path string) bool {
+	rel, ok := g.relSegments(path)
+	return ok && prefixSegments(g.segments, rel)
+}
+
+// match returns the location a matched file is tailed as. The label is the
+// path relative to the root of the pattern, prefixed by the configured label
+// if there is one.
+func (g globPattern) match(path string) location {
+	l := g.location
+	l.path = path
+	l.label = filepath.Base(path)
+	if rel, err := filepath.Rel(g.root, path); err == nil {
+		l.label = rel
+	}
+	if g.label != "" {
+		l.label = g.label + "/" + l.label
+	}
+	return l
+}
+
+// matchSegments matches a path, split into its segments, against a pattern.
+// Each segment is matched with filepath.Match, except for ** which matches
+// zero or more segments.
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], name[0])
+	return err == nil && ok && matchSegments(pattern[1:], name[1:])
+}
+
+// prefixSegments reports whether the directory, split into its segments,
+// could be the start of a path that matches the pattern.
+func prefixSegments(pattern, dir []string) bool {
+	if len(dir) == 0 {
+		return len(pattern) > 0
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	ok, err := filepath.Match(pattern[0], dir[0])
+	return err == nil && ok && prefixSegments(pattern[1:], dir[1:])
+}
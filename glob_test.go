@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.log", "app.log", true},
+		{"*.log", "app.log.1", false},
+		{"*.log", "dir/app.log", false},
+		{"app-?.log", "app-1.log", true},
+		{"app-[0-9].log", "app-a.log", false},
+		{"*/*.log", "web/app.log", true},
+		{"*/*.log", "app.log", false},
+		{"**/*.log", "app.log", true},
+		{"**/*.log", "a/b/c/app.log", true},
+		{"**/*.log", "a/b/c/app.txt", false},
+		{"a/**/b/*.log", "a/b/x.log", true},
+		{"a/**/b/*.log", "a/x/y/b/x.log", true},
+		{"a/**/b/*.log", "a/x/y/c/x.log", false},
+		{"**", "anything/at/all", true},
+		{"**/**/*.log", "a/app.log", true},
+		{"[.log", "[.log", false},
+	}
+	split := func(s string) []string { return strings.Split(s, "/") }
+	for _, test := range tests {
+		if match := matchSegments(split(test.pattern), split(test.name)); match != test.match {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", test.pattern, test.name, match, test.match)
+		}
+	}
+}
+
+func TestGlobPattern(t *testing.T) {
+	root := filepath.FromSlash("/var/log")
+	g := newGlobPattern(location{path: filepath.Join(root, "**", "*.log"), label: "logs"})
+	if g.root != root {
+		t.Fatalf("got root %s, want %s", g.root, root)
+	}
+
+	tests := []struct {
+		path       string
+		matches    bool
+		mayContain bool
+	}{
+		{filepath.Join(root, "app.log"), true, true},
+		{filepath.Join(root, "nginx", "access.log"), true, true},
+		{filepath.Join(root, "nginx", "access.log.1"), false, true},
+		{filepath.FromSlash("/var/other/app.log"), false, false},
+		{filepath.FromSlash("/var"), false, false},
+	}
+	for _, test := range tests {
+		if matches := g.matches(test.path); matches != test.matches {
+			t.Errorf("matches(%s) = %v, want %v", test.path, matches, test.matches)
+		}
+		if mayContain := g.mayContain(test.path); mayContain != test.mayContain {
+			t.Errorf("mayContain(%s) = %v, want %v", test.path, mayContain, test.mayContain)
+		}
+	}
+
+	if l := g.match(filepath.Join(root, "nginx", "access.log")); l.label != "logs/"+filepath.Join("nginx", "access.log") {
+		t.Errorf("got label %s", l.label)
+	}
+}
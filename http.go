@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var errInvalidHistory = errors.New("history must be a number of lines, 0 or more")
+
+// streamHeartbeat is how often an idle stream is sent something, so proxies
+// and browsers do not give up on it.
+const streamHeartbeat = 15 * time.Second
+
+// streamServer serves the aggregated events over http. /events streams them
+// as Server-Sent Events, /ws over a WebSocket, and / is a page for watching
+// them from a browser.
+type streamServer struct {
+	hub    *hub
+	server *http.Server
+}
+
+// startStreamServer starts listening on addr, serving the events handed to
+// the hub.
+func startStreamServer(addr string, h *hub) (*streamServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &streamServer{hub: h}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ss.serveViewer)
+	mux.HandleFunc("/events", ss.serveEvents)
+	mux.HandleFunc("/ws", ss.serveWebsocket)
+	ss.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := ss.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("The http server stopped:", err)
+		}
+	}()
+	log.Println("Streaming aggregated lines over http at:", ln.Addr())
+	return ss, nil
+}
+
+// close stops the server. The hub should be closed first, which ends the
+// streams that are still open.
+func (ss *streamServer) close() {
+	ss.server.Close()
+}
+
+// parseStreamFilter reads the filter a client asked for from the query. The
+// source parameter can be given more than once, as can include, exclude,
+// contains and notContains, min-level is a single level. history is how many
+// of the recent lines the client wants first, all we have when it is not
+// given.
+func parseStreamFilter(q url.Values) (eventFilter, int, error) {
+	f := eventFilter{sources: q["source"]}
+	filter, err := newLineFilter(q["include"], q["exclude"], q["contains"], q["notContains"])
+	if err != nil {
+		return f, 0, err
+	}
+	if !filter.empty() {
+		f.filters = []*lineFilter{filter}
+	}
+	if f.minLevel, err = parseMinLevel(q.Get("min-level")); err != nil {
+		return f, 0, err
+	}
+	history := -1
+	if v := q.Get("history"); v != "" {
+		if history, err = strconv.Atoi(v); err != nil || history < 0 {
+			return f, 0, errInvalidHistory
+		}
+	}
+	return f, history, nil
+}
+
+// subscribe subscribes to the hub with the filter in the request's query,
+// answering with a bad request when it is invalid.
+func (ss *streamServer) subscribe(w http.ResponseWriter, r *http.Request) (*subscriber, bool) {
+	f, history, err := parseStreamFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return ss.hub.subscribe(f, history), true
+}
+
+// writeServerSentEvent writes the event as a single Server-Sent Event.
+func writeServerSentEvent(w io.Writer, e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Leave out the event rather than ending the stream.
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
+
+// writeWebsocketEvent writes the event as a single text message.
+func writeWebsocketEvent(ws *websocketConn, e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Leave out the event rather than ending the stream.
+		return nil
+	}
+	return ws.writeText(b)
+}
+
+// serveEvents streams events as Server-Sent Events, each one a json object
+// in the same shape as -output-format json.
+func (ss *streamServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, ok := ss.subscribe(w, r)
+	if !ok {
+		return
+	}
+	defer ss.hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range sub.backlog {
+		if err := writeServerSentEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := writeServerSentEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveWebsocket streams events over a WebSocket, one json object per text
+// message.
+func (ss *streamServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	sub, ok := ss.subscribe(w, r)
+	if !ok {
+		return
+	}
+	defer ss.hub.unsubscribe(sub)
+
+	ws, err := upgradeWebsocket(w, r)
+	if err == errCrossOrigin {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ws.close()
+	for _, e := range sub.backlog {
+		if err := writeWebsocketEvent(ws, e); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				ws.writeFrame(opClose, nil)
+				return
+			}
+			if err := writeWebsocketEvent(ws, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := ws.writeFrame(opPing, nil); err != nil {
+				return
+			}
+		case <-ws.closed:
+			return
+		}
+	}
+}
+
+// serveViewer serves the page for watching the stream from a browser.
+func (ss *streamServer) serveViewer(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, viewerPage)
+}
+
+// viewerPage follows /events, passing the filters in its form along as the
+// query. Only the newest lines are kept on the page. Every time the stream
+// (re)connects the recent lines are sent again, so the page starts over.
+const viewerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>aggregator</title>
+<style>
+body { margin: 0; font-family: monospace; background: #1d1f21; color: #c5c8c6; }
+form { position: sticky; top: 0; padding: 8px; background: #282a2e; display: flex; gap: 8px; flex-wrap: wrap; }
+input, select, button { font-family: inherit; }
+#lines { padding: 8px; white-space: pre-wrap; word-break: break-all; }
+.label { color: #81a2be; }
+.late { color: #969896; }
+.trace, .debug { color: #969896; }
+.warn { color: #f0c674; }
+.error, .fatal { color: #cc6666; }
+#status { margin-left: auto; color: #969896; }
+</style>
+</head>
+<body>
+<form id="filters">
+<input name="source" placeholder="source">
+<input name="include" placeholder="include regexp">
+<input name="exclude" placeholder="exclude regexp">
+<select name="min-level">
+<option value="">any level</option>
+<option>trace</option><option>debug</option><option>info</option>
+<option>warn</option><option>error</option><option>fatal</option>
+</select>
+<button type="submit">Apply</button>
+<label><input type="checkbox" id="follow" checked> follow</label>
+<span id="status"></span>
+</form>
+<div id="lines"></div>
+<script>
+var maxLines = 5000;
+var lines = document.getElementById("lines");
+var state = document.getElementById("status");
+var form = document.getElementById("filters");
+var source;
+
+function connect() {
+	if (source) source.close();
+	var query = new URLSearchParams();
+	new FormData(form).forEach(function(v, k) { if (v) query.append(k, v); });
+	source = new EventSource("events?" + query.toString());
+	source.onopen = function() {
+		lines.textContent = "";
+		state.textContent = "connected";
+	};
+	source.onerror = function() { state.textContent = "reconnecting..."; };
+	source.onmessage = function(msg) {
+		var e = JSON.parse(msg.data);
+		var div = document.createElement("div");
+		if (e.level) div.className = e.level;
+		var label = document.createElement("span");
+		label.className = "label";
+		label.textContent = "[" + (e.label || e.source) + "] ";
+		div.appendChild(label);
+		if (e.late) {
+			var late = document.createElement("span");
+			late.className = "late";
+			late.textContent = "(late) ";
+			div.appendChild(late);
+		}
+		div.appendChild(document.createTextNode(e.line));
+		lines.appendChild(div);
+		while (lines.childNodes.length > maxLines) lines.removeChild(lines.firstChild);
+		if (document.getElementById("follow").checked) window.scrollTo(0, document.body.scrollHeight);
+	};
+}
+
+form.onsubmit = function(ev) {
+	ev.preventDefault();
+	connect();
+};
+connect();
+</script>
+</body>
+</html>
+`
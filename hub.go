@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// subscriberBuffer is how many events can be waiting for a subscriber before
+// events for it are dropped.
+const subscriberBuffer = 256
+
+// subscriber is a single consumer of the live stream of events, such as a
+// browser connected to the http server. backlog holds the recent events it
+// should be sent before the ones arriving on events.
+type subscriber struct {
+	eventFilter
+	backlog []*event
+	events  chan *event
+	dropped uint64
+}
+
+// hub hands every event to each of its subscribers that wants it. A
+// subscriber that does not keep up has events dropped rather than holding up
+// the others. The hub remembers the most recent events in history, so a new
+// subscriber does not have to wait for the next one to see something.
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	history     *eventRing
+	closed      bool
+}
+
+// newHub returns a hub without any subscribers, it remembers at most
+// historyLines events and historyBytes of their text.
+func newHub(historyLines, historyBytes int) *hub {
+	return &hub{
+		subscribers: make(map[*subscriber]struct{}),
+		history:     newEventRing(historyLines, historyBytes),
+	}
+}
+
+// write implements eventOutput.
+func (h *hub) write(src *source, e *event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.history.add(src, e)
+	for s := range h.subscribers {
+		if !s.wants(src, e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			if n := atomic.AddUint64(&s.dropped, 1); n == 1 || n%sinkReportEvery == 0 {
+				log.Println("Stream subscriber is falling behind, lines dropped so far:", n)
+			}
+		}
+	}
+}
+
+// subscribe adds a subscriber for the events that make it through the
+// filter. Its backlog holds the newest history of the remembered events it
+// wants, all of them when history is below 0. As the backlog is taken while
+// holding the same lock as write, no event is missed or seen twice between
+// it and the events channel. The channel is closed when the subscriber is
+// unsubscribed, or when the hub is closed.
+func (h *hub) subscribe(f eventFilter, history int) *subscriber {
+	s := &subscriber{eventFilter: f, events: make(chan *event, subscriberBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.backlog = h.history.recent(f, history)
+	if h.closed {
+		close(s.events)
+		return s
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+// unsubscribe removes the subscriber from the hub.
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// close removes every subscriber, which ends their streams.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// outputs hands every event to each of the outputs in turn.
+type outputs []eventOutput
+
+// write implements eventOutput.
+func (o outputs) write(src *source, e *event) {
+	for _, out := range o {
+		out.write(src, e)
+	}
+}
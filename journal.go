@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/spf13/cast"
+)
+
+const (
+	// locationJournal is the Type of the entries under Locations that read
+	// the systemd journal.
+	locationJournal = "journal"
+
+	// maxJournalField is the largest binary field of an entry in the export
+	// format we read.
+	maxJournalField = 16 << 20
+)
+
+var (
+	errJournalFieldTooLarge = errors.New("a field of a journal entry was larger than we accept")
+	errInvalidPriority      = errors.New("Priority must be one of emerg, alert, crit, err, warning, notice, info or debug, or a number from 0 to 7")
+
+	// journalPriorities are the names a Priority may be given by besides the
+	// names of the syslog severities.
+	journalPriorities = map[string]int{
+		"emergency": 0,
+		"critical":  2,
+		"error":     3,
+		"warn":      4,
+	}
+
+	// journalKeys are the fields of an entry that are handed to the sources,
+	// the rest of them are dropped.
+	journalKeys = []string{"MESSAGE", "PRIORITY", "_SYSTEMD_UNIT", "__REALTIME_TIMESTAMP", "_HOSTNAME", "SYSLOG_IDENTIFIER", "_COMM", "_PID"}
+)
+
+// journalSpec is where the entries of the journal are read from, and which
+// of them are kept. Without a path journalctl is run to follow the journal,
+// otherwise the export or json output of journalctl is read from the file at
+// path, or from stdin for -. Entries are kept when they are from one of the
+// units, when there are any, and when their priority is no higher than
+// priority, when it is not -1. The labels of the entries' sources are put
+// behind prefix, when it is set.
+type journalSpec struct {
+	path     string
+	units    []string
+	priority int
+	prefix   string
+}
+
+// parseJournalLocation reads an entry of Locations with a Type of journal.
+// Path, Units, Priority and Label are all optional.
+func parseJournalLocation(settings map[string]interface{}, defaults location) (location, error) {
+	spec := &journalSpec{
+		path:     cast.ToString(settings["path"]),
+		units:    toStrings(settings["units"]),
+		priority: -1,
+		prefix:   cast.ToString(settings["label"]),
+	}
+	if v, ok := settings["priority"]; ok {
+		var err error
+		if spec.priority, err = parseJournalPriority(cast.ToString(v)); err != nil {
+			return location{}, err
+		}
+	}
+
+	l := defaults
+	l.path = "journal:" + spec.String()
+	l.label = spec.prefix
+	if l.label == "" {
+		l.label = locationJournal
+	}
+	l.journal = spec
+	return l, nil
+}
+
+// parseJournalPriority parses a priority given by its number, or its name.
+func parseJournalPriority(name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil && n >= 0 && n < len(syslogSeverities) {
+		return n, nil
+	}
+	name = strings.ToLower(name)
+	for n, severity := range syslogSeverities {
+		if name == severity {
+			return n, nil
+		}
+	}
+	if n, ok := journalPriorities[name]; ok {
+		return n, nil
+	}
+	return 0, errInvalidPriority
+}
+
+// String describes where the spec reads from and what it keeps, it is what
+// the path of its location is made of.
+func (spec *journalSpec) String() string {
+	parts := []string{spec.path}
+	if spec.path == "" {
+		parts[0] = "journalctl"
+	}
+	units := append([]string{}, spec.units...)
+	sort.Strings(units)
+	for _, u := range units {
+		parts = append(parts, "unit="+u)
+	}
+	if spec.priority >= 0 {
+		parts = append(parts, "priority="+syslogSeverities[spec.priority])
+	}
+	return strings.Join(parts, ",")
+}
+
+// journalctlArgs returns the arguments journalctl is run with. StartAt
+// decides which entries it starts with, beginning being the entries of the
+// current boot.
+func (spec *journalSpec) journalctlArgs(start string) []string {
+	args := []string{"journalctl", "--follow", "--output=json"}
+	switch start {
+	case startBeginning:
+		args = append(args, "--boot", "--lines=all")
+	case startEnd:
+		args = append(args, "--lines=0")
+	default:
+		args = append(args, "--lines="+start)
+	}
+	for _, u := range spec.units {
+		args = append(args, "--unit="+u)
+	}
+	if spec.priority >= 0 {
+		args = append(args, "--priority="+strconv.Itoa(spec.priority))
+	}
+	return args
+}
+
+// keeps reports whether the entry passes the spec's unit and priority
+// filters. journalctl applies them as well, but the entries read from a file
+// or stdin are only filtered here.
+func (spec *journalSpec) keeps(entry map[string]string) bool {
+	if spec.priority >= 0 {
+		if p, err := strconv.Atoi(entry["PRIORITY"]); err == nil && p > spec.priority {
+			return false
+		}
+	}
+	if len(spec.units) == 0 {
+		return true
+	}
+	unit := entry["_SYSTEMD_UNIT"]
+	for _, u := range spec.units {
+		if unit == u || unit == u+".service" {
+			return true
+		}
+	}
+	return false
+}
+
+// isJournal reports whether the location reads the systemd journal.
+func (l location) isJournal() bool {
+	return l.journal != nil
+}
+
+// startJournal starts reading the location's journal entries, adding a
+// source for it. The entries go to the sources of each of the units they are
+// from. Callers hold the lock.
+func (ts *tailSet) startJournal(l location) error {
+	jr, err := openJournal(l, ts)
+	if err != nil {
+		return err
+	}
+	ts.startSource(&source{location: l, lines: jr.lines, stop: jr.stop})
+	return nil
+}
+
+// journalUnit is the source of the entries of a unit.
+type journalUnit struct {
+	*source
+	lines chan *tail.Line
+}
+
+// journalReader hands each journal entry to the source of its unit, adding a
+// source for each unit as its first entry comes in.
+type journalReader struct {
+	location
+	tails    *tailSet
+	lines    chan *tail.Line
+	sources  map[string]*journalUnit
+	quit     chan struct{}
+	closer   func()
+	stopOnce sync.Once
+}
+
+// openJournal runs journalctl, or opens the file the location reads from,
+// and starts handing the entries to the sources of their units.
+func openJournal(l location, tails *tailSet) (*journalReader, error) {
+	jr := &journalReader{
+		location: l,
+		tails:    tails,
+		lines:    make(chan *tail.Line),
+		sources:  make(map[string]*journalUnit),
+		quit:     make(chan struct{}),
+	}
+
+	switch l.journal.path {
+	case "":
+		cl := l
+		cl.command = &commandSpec{args: l.journal.journalctlArgs(l.options.start)}
+		p, err := startProcess(cl)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			for line := range p.stderr {
+				log.Println("journalctl:", line.Text)
+			}
+		}()
+		jr.closer = p.stop
+		go jr.readLines(p.stdout)
+	case stdinPath:
+		pr, pw := io.Pipe()
+		jr.closer = func() { pr.Close() }
+		go forwardJournalStdin(pw, jr.quit)
+		go jr.readEntries(pr)
+	default:
+		f, err := os.Open(l.journal.path)
+		if err != nil {
+			return nil, err
+		}
+		jr.closer = func() { f.Close() }
+		go jr.readEntries(f)
+	}
+	return jr, nil
+}
+
+var (
+	journalStdinOnce   sync.Once
+	journalStdinChunks = make(chan []byte)
+)
+
+// forwardJournalStdin writes what is read from stdin to w until stdin runs
+// out or quit is closed, closing w either way. Like the lines of
+// forwardStdin, stdin is only read once, so a reader that replaces another
+// picks up where it left off.
+func forwardJournalStdin(w *io.PipeWriter, quit <-chan struct{}) {
+	defer w.Close()
+	journalStdinOnce.Do(func() {
+		go func() {
+			defer close(journalStdinChunks)
+			for {
+				b := make([]byte, 32*1024)
+				n, err := os.Stdin.Read(b)
+				if n > 0 {
+					journalStdinChunks <- b[:n]
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
+	for {
+		select {
+		case b, ok := <-journalStdinChunks:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// readLines reads the json output of journalctl, an entry per line. Once
+// the reader is stopped the lines are drained until journalctl exits.
+func (jr *journalReader) readLines(lines <-chan *tail.Line) {
+	defer jr.close()
+	for line := range lines {
+		if entry, ok := parseJournalJSON([]byte(line.Text)); ok && !jr.isStopped() {
+			jr.route(entry)
+		}
+	}
+}
+
+// readEntries reads the export or json output of journalctl from r until it
+// runs out, telling the two apart by the first byte of it.
+func (jr *journalReader) readEntries(r io.Reader) {
+	defer jr.close()
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == '{' {
+		for {
+			line, err := br.ReadBytes('\n')
+			if entry, ok := parseJournalJSON(line); ok && !jr.route(entry) {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		entry, err := readJournalExport(br)
+		if len(entry) > 0 && !jr.route(entry) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !jr.isStopped() {
+				log.Println("Unable to read the journal entries of", jr.journal.path, err)
+			}
+			return
+		}
+	}
+}
+
+// route hands the entry to the source of its unit, unless it is filtered
+// out. Entries that are not from a unit go to the source of the program that
+// logged them. It returns false once the reader is stopped.
+func (jr *journalReader) route(entry map[string]string) bool {
+	if !jr.journal.keeps(entry) {
+		return true
+	}
+	name := entry["_SYSTEMD_UNIT"]
+	for _, key := range []string{"SYSLOG_IDENTIFIER", "_COMM"} {
+		if name == "" {
+			name = entry[key]
+		}
+	}
+	if name == "" {
+		name = locationJournal
+	}
+
+	unit, ok := jr.sources[name]
+	if !ok {
+		l := jr.location
+		l.path = jr.path + string(filepath.Separator) + name
+		l.label = name
+		if jr.journal.prefix != "" {
+			l.label = jr.journal.prefix + "/" + name
+		}
+		unit = &journalUnit{lines: make(chan *tail.Line)}
+		unit.source = &source{location: l, lines: unit.lines, stop: jr.stop}
+		if !jr.tails.addChild(jr.quit, unit.source) {
+			return false
+		}
+		jr.sources[name] = unit
+	}
+
+	kept := make(map[string]string, len(journalKeys))
+	for _, key := range journalKeys {
+		if v, ok := entry[key]; ok {
+			kept[key] = v
+		}
+	}
+	b, _ := json.Marshal(kept)
+	select {
+	case unit.lines <- &tail.Line{Text: string(b), Time: time.Now()}:
+		return true
+	case <-jr.quit:
+		return false
+	}
+}
+
+// close ends the sources of the units once there are no more entries.
+func (jr *journalReader) close() {
+	for _, unit := range jr.sources {
+		close(unit.lines)
+		jr.tails.dropChild(unit.source)
+	}
+	close(jr.lines)
+}
+
+func (jr *journalReader) isStopped() bool {
+	select {
+	case <-jr.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops reading entries. It does not wait for journalctl to exit, as
+// the entries it is still handing over need the tailSet's lock, which is held
+// while stopping us. It is safe to call more than once.
+func (jr *journalReader) stop() {
+	jr.stopOnce.Do(func() {
+		close(jr.quit)
+		go jr.closer()
+	})
+}
+
+// parseJournalJSON parses an entry of journalctl's json output. Fields that
+// are not valid utf-8 are arrays of bytes, and fields that were logged more
+// than once are arrays of their values, of which the first one is kept.
+func parseJournalJSON(line []byte) (map[string]string, bool) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, false
+	}
+	entry := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if values, ok := v.([]interface{}); ok && len(values) > 0 {
+			if _, ok := values[0].(float64); !ok {
+				v = values[0]
+			}
+		}
+		switch v := v.(type) {
+		case string:
+			entry[k] = v
+		case []interface{}:
+			b := make([]byte, 0, len(v))
+			for _, n := range v {
+				b = append(b, byte(cast.ToInt(n)))
+			}
+			entry[k] = string(b)
+		}
+	}
+	return entry, true
+}
+
+// readJournalExport reads the next entry of journalctl's export format, its
+// fields each on a line of their own as KEY=VALUE, ending at an empty line.
+// Fields whose values are binary or span several lines are written as the
+// key on its own line, followed by the length of the value as a little
+// endian 64 bit integer, the value and a newline.
+func readJournalExport(br *bufio.Reader) (map[string]string, error) {
+	entry := make(map[string]string)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return entry, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) == 0 {
+			if len(entry) == 0 {
+				continue
+			}
+			return entry, nil
+		}
+
+		if i := bytes.IndexByte(line, '='); i >= 0 {
+			entry[string(line[:i])] = string(line[i+1:])
+			continue
+		}
+		var size [8]byte
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return entry, err
+		}
+		n := binary.LittleEndian.Uint64(size[:])
+		if n > maxJournalField {
+			return entry, errJournalFieldTooLarge
+		}
+		value := make([]byte, n+1)
+		if _, err := io.ReadFull(br, value); err != nil {
+			return entry, err
+		}
+		entry[string(line)] = string(value[:n])
+	}
+}
+
+// readJournalEvent fills in the event from the journal entry in its text.
+// The message is the event's text, its priority sets the level, the time it
+// was logged at is its timestamp and the host it was logged on is its host.
+// The unit, priority, identifier and pid are kept in the event's fields. The
+// source's parser is applied to the message itself.
+func readJournalEvent(s *source, e *event) {
+	entry, ok := parseJournalJSON([]byte(e.Text))
+	if !ok {
+		e.Level = detectLevel(s.levelPatterns, nil, e.Text)
+		e.Timestamp = e.Received
+		return
+	}
+
+	e.Fields, e.Text, _ = s.parser.parse(entry["MESSAGE"])
+	if e.Fields == nil {
+		e.Fields = make(map[string]interface{})
+	}
+	if p, err := strconv.Atoi(entry["PRIORITY"]); err == nil && p >= 0 && p < len(syslogLevels) {
+		e.Level = syslogLevels[p]
+		e.Fields["priority"] = syslogSeverities[p]
+	} else {
+		e.Level = detectLevel(s.levelPatterns, nil, e.Text)
+	}
+	fields := map[string]string{
+		"unit":       entry["_SYSTEMD_UNIT"],
+		"identifier": entry["SYSLOG_IDENTIFIER"],
+		"pid":        entry["_PID"],
+	}
+	for k, v := range fields {
+		if v != "" {
+			e.Fields[k] = v
+		}
+	}
+
+	e.Timestamp = e.Received
+	if usec, err := strconv.ParseInt(entry["__REALTIME_TIMESTAMP"], 10, 64); err == nil {
+		e.Timestamp = time.Unix(0, usec*int64(time.Microsecond))
+	}
+	if host := entry["_HOSTNAME"]; host != "" {
+		e.Host = host
+	}
+}
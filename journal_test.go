@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// exportField returns a field of an entry in journalctl's export format, as
+// KEY=VALUE for text and in the length prefixed form for binary values.
+func exportField(key, value string, binaryValue bool) string {
+	if !binaryValue {
+		return key + "=" + value + "\n"
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	return key + "\n" + string(size[:]) + value + "\n"
+}
+
+// exportEntries is a stream of entries in the export format: a binary error
+// from nginx, an info line from nginx, a critical line from sshd and a
+// warning from nginx.
+func exportEntries() string {
+	return exportField("__REALTIME_TIMESTAMP", "1700000000000000", false) +
+		exportField("_SYSTEMD_UNIT", "nginx.service", false) +
+		exportField("PRIORITY", "3", false) +
+		exportField("MESSAGE", "upstream timed out\nwhile reading\x00", true) +
+		exportField("_HOSTNAME", "web1", false) +
+		"\n" +
+		exportField("_SYSTEMD_UNIT", "nginx.service", false) +
+		exportField("PRIORITY", "6", false) +
+		exportField("MESSAGE", "GET /", false) +
+		"\n" +
+		exportField("_SYSTEMD_UNIT", "sshd.service", false) +
+		exportField("PRIORITY", "2", false) +
+		exportField("MESSAGE", "fatal: out of memory", false) +
+		"\n" +
+		exportField("_SYSTEMD_UNIT", "nginx.service", false) +
+		exportField("PRIORITY", "4", false) +
+		exportField("MESSAGE", "reloaded=yes", false) +
+		"\n"
+}
+
+func TestReadJournalExport(t *testing.T) {
+	br := bufio.NewReader(bytes.NewBufferString(exportEntries()))
+	var entries []map[string]string
+	for {
+		entry, err := readJournalExport(br)
+		if len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4", len(entries))
+	}
+	if got, want := entries[0]["MESSAGE"], "upstream timed out\nwhile reading\x00"; got != want {
+		t.Errorf("got binary message %q, want %q", got, want)
+	}
+	if got := entries[0]["_HOSTNAME"]; got != "web1" {
+		t.Errorf("got the field after the binary one as %q, want web1", got)
+	}
+	if got := entries[3]["MESSAGE"]; got != "reloaded=yes" {
+		t.Errorf("got message %q, want it split at the first =", got)
+	}
+}
+
+func TestReadJournalExportErrors(t *testing.T) {
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], maxJournalField+1)
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"field too large", "MESSAGE\n" + string(size[:]), errJournalFieldTooLarge},
+		{"binary field cut short", exportField("MESSAGE", "cut short", true)[:15], io.ErrUnexpectedEOF},
+		{"entry without an empty line", "MESSAGE=last\n", io.EOF},
+	}
+	for _, test := range tests {
+		_, err := readJournalExport(bufio.NewReader(bytes.NewBufferString(test.input)))
+		if err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestJournalSpecKeeps(t *testing.T) {
+	tests := []struct {
+		name     string
+		units    []string
+		priority int
+		entry    map[string]string
+		keep     bool
+	}{
+		{"no filters", nil, -1, map[string]string{"PRIORITY": "7"}, true},
+		{"unit", []string{"nginx"}, -1, map[string]string{"_SYSTEMD_UNIT": "nginx.service"}, true},
+		{"unit with its suffix", []string{"nginx.service"}, -1, map[string]string{"_SYSTEMD_UNIT": "nginx.service"}, true},
+		{"another unit", []string{"nginx"}, -1, map[string]string{"_SYSTEMD_UNIT": "sshd.service"}, false},
+		{"without a unit", []string{"nginx"}, -1, map[string]string{"SYSLOG_IDENTIFIER": "kernel"}, false},
+		{"priority at the limit", nil, 4, map[string]string{"PRIORITY": "4"}, true},
+		{"priority above the limit", nil, 4, map[string]string{"PRIORITY": "6"}, false},
+		{"without a priority", nil, 4, map[string]string{"MESSAGE": "hi"}, true},
+		{"unit and priority", []string{"nginx"}, 3, map[string]string{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "4"}, false},
+	}
+	for _, test := range tests {
+		spec := &journalSpec{units: test.units, priority: test.priority}
+		if keep := spec.keeps(test.entry); keep != test.keep {
+			t.Errorf("%s: got %v, want %v", test.name, keep, test.keep)
+		}
+	}
+}
+
+func TestJournalReadsExportFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "aggregator-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(exportEntries()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	settings := map[string]interface{}{
+		"path":     f.Name(),
+		"units":    []interface{}{"nginx"},
+		"priority": "warning",
+	}
+	l, err := parseJournalLocation(settings, location{options: defaultTailOptions()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(eventChan, 10)
+	ts := newTailSet(events, nil, false)
+	if err := ts.add(l); err != nil {
+		t.Fatal(err)
+	}
+
+	first := events.next(t)
+	second := events.next(t)
+	ts.stopAll()
+	if len(events) > 0 {
+		t.Errorf("got %q, which should have been filtered out", (<-events).Text)
+	}
+
+	if first.Label != "nginx.service" || first.Text != "upstream timed out\nwhile reading\x00" {
+		t.Errorf("got %q from %s", first.Text, first.Label)
+	}
+	if first.Level != levelError || first.Fields["priority"] != "err" || first.Fields["unit"] != "nginx.service" {
+		t.Errorf("got level %v and fields %v", first.Level, first.Fields)
+	}
+	if want := time.Unix(1700000000, 0); !first.Timestamp.Equal(want) || first.Host != "web1" {
+		t.Errorf("got timestamp %v and host %q", first.Timestamp, first.Host)
+	}
+	if second.Text != "reloaded=yes" || second.Level != levelWarn {
+		t.Errorf("got %q at level %v", second.Text, second.Level)
+	}
+	if filepath.Dir(first.Source) != l.path {
+		t.Errorf("got source %s, want it beneath %s", first.Source, l.path)
+	}
+}
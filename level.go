@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// level is the severity of an event, levelUnknown is used for events we could
+// not find a level in.
+type level int
+
+const (
+	levelUnknown level = iota
+	levelTrace
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+	levelFatal
+)
+
+var (
+	errInvalidLevel        = errors.New("the minimum level must be one of trace, debug, info, warn, error or fatal")
+	errInvalidLevelPattern = errors.New("each LevelPattern must have a capture group holding the level")
+
+	levelNames = map[string]level{
+		"trace":    levelTrace,
+		"debug":    levelDebug,
+		"dbg":      levelDebug,
+		"info":     levelInfo,
+		"inf":      levelInfo,
+		"notice":   levelInfo,
+		"warn":     levelWarn,
+		"warning":  levelWarn,
+		"wrn":      levelWarn,
+		"error":    levelError,
+		"err":      levelError,
+		"eror":     levelError,
+		"fatal":    levelFatal,
+		"critical": levelFatal,
+		"crit":     levelFatal,
+		"panic":    levelFatal,
+		"dpanic":   levelFatal,
+	}
+
+	// levelColors are the ansi colors a line is written in when writing text
+	// to a terminal, levels without a color are written as they are.
+	levelColors = map[level]string{
+		levelTrace: "90",
+		levelDebug: "90",
+		levelWarn:  "33",
+		levelError: "31",
+		levelFatal: "1;31",
+	}
+
+	// levelKeys are the field names json and logfmt logs commonly keep the
+	// level in.
+	levelKeys = []string{"level", "lvl", "severity", "loglevel"}
+
+	jsonLevelPattern    = regexp.MustCompile(`"(?:level|lvl|severity|loglevel)"\s*:\s*"?([A-Za-z]+|[0-9]+)`)
+	logfmtLevelPattern  = regexp.MustCompile(`(?:^|\s)(?:level|lvl|severity|loglevel)="?([A-Za-z]+)`)
+	bracketLevelPattern = regexp.MustCompile(`\[([A-Za-z]+)\]`)
+)
+
+// String returns the canonical name of the level.
+func (l level) String() string {
+	switch l {
+	case levelTrace:
+		return "trace"
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	case levelFatal:
+		return "fatal"
+	}
+	return ""
+}
+
+// MarshalJSON writes the level by name, unknown levels are written as null.
+func (l level) MarshalJSON() ([]byte, error) {
+	if l == levelUnknown {
+		return []byte("null"), nil
+	}
+	return json.Marshal(l.String())
+}
+
+// parseLevel looks up a level by any of the names services commonly use for
+// it, ignoring case. Numbers are read in the style of bunyan and pino, where
+// 30 is info, 40 is warn, and so on.
+func parseLevel(name string) level {
+	n, err := strconv.Atoi(name)
+	if err != nil {
+		return levelNames[strings.ToLower(name)]
+	}
+	switch {
+	case n >= 60:
+		return levelFatal
+	case n >= 50:
+		return levelError
+	case n >= 40:
+		return levelWarn
+	case n >= 30:
+		return levelInfo
+	case n >= 20:
+		return levelDebug
+	case n >= 10:
+		return levelTrace
+	}
+	return levelUnknown
+}
+
+// parseMinLevel parses the level given to -min-level, an empty string means
+// every event is kept.
+func parseMinLevel(name string) (level, error) {
+	if name == "" {
+		return levelUnknown, nil
+	}
+	l := parseLevel(name)
+	if l == levelUnknown {
+		return l, errInvalidLevel
+	}
+	return l, nil
+}
+
+// compileLevelPatterns compiles the LevelPattern regular expressions of a
+// location, each of them has to capture the level in its first group.
+func compileLevelPatterns(raw interface{}) ([]*regexp.Regexp, error) {
+	patterns, err := compileAll(toStrings(raw), false)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range patterns {
+		if p.NumSubexp() < 1 {
+			return nil, errInvalidLevelPattern
+		}
+	}
+	return patterns, nil
+}
+
+// detectLevel finds the level of an event. The location's own patterns are
+// tried first, followed by the fields of a parsed json line, then the
+// recognizers for json, logfmt and bracketed [LEVEL] text.
+func detectLevel(patterns []*regexp.Regexp, fields map[string]interface{}, text string) level {
+	for _, p := range patterns {
+		if m := p.FindStringSubmatch(text); m != nil {
+			if l := parseLevel(m[1]); l != levelUnknown {
+				return l
+			}
+		}
+	}
+
+	for _, k := range levelKeys {
+		if v, ok := fields[k]; ok {
+			if l := fieldLevel(v); l != levelUnknown {
+				return l
+			}
+		}
+	}
+
+	for _, p := range []*regexp.Regexp{jsonLevelPattern, logfmtLevelPattern} {
+		if m := p.FindStringSubmatch(text); m != nil {
+			if l := parseLevel(m[1]); l != levelUnknown {
+				return l
+			}
+		}
+	}
+
+	for _, m := range bracketLevelPattern.FindAllStringSubmatch(text, -1) {
+		if l := parseLevel(m[1]); l != levelUnknown {
+			return l
+		}
+	}
+	return levelUnknown
+}
+
+// fieldLevel reads a level out of a json field, which is either a name or a
+// number.
+func fieldLevel(v interface{}) level {
+	return parseLevel(cast.ToString(v))
+}
+
+// colorizeLevel wraps the text in the color of its level.
+func colorizeLevel(l level, text string) string {
+	color, ok := levelColors[l]
+	if !ok {
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
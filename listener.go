@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/spf13/cast"
+)
+
+const (
+	// locationSyslog is the Type of the entries under Locations that listen
+	// for syslog messages.
+	locationSyslog = "syslog"
+
+	// locationListen is the Type of the entries under Locations that listen
+	// for lines sent by apps over the network.
+	locationListen = "listen"
+
+	formatLines = "lines"
+
+	framingNewline = "newline"
+	framingLength  = "length"
+
+	// defaultMaxLineSize is the longest message we read from a listener, the
+	// rest of a message that is longer is dropped.
+	defaultMaxLineSize = 64 * 1024
+
+	// remoteIdleTimeout is how long the source of a remote address sending
+	// datagrams is kept after the last one it sent.
+	remoteIdleTimeout = 5 * time.Minute
+
+	// maxOctetCountDigits is how many digits the length in front of an
+	// octet counted message may have.
+	maxOctetCountDigits = 10
+)
+
+var (
+	errInvalidListen  = errors.New("Listen must be an address such as udp://:5514, tcp://127.0.0.1:5514, unix:///path/to/socket or unixgram:///path/to/socket")
+	errInvalidFraming = errors.New("Framing must either be newline or length")
+	errFrameTooLong   = errors.New("the octet count of a message was longer than we accept")
+	errInvalidOctets  = errors.New("the octet count of a message was not a number followed by a space")
+)
+
+// listenerSpec is an address we listen on for messages sent to us, rather
+// than reading them from a file. A syslog listener adds every message to a
+// single source, while a line listener adds a source for each connection, or
+// for each remote address sending it datagrams. Lines beyond rateLimit a
+// second are dropped per connection, when it is set.
+type listenerSpec struct {
+	network     string
+	address     string
+	format      string
+	framing     string
+	maxLineSize int
+	rateLimit   int
+}
+
+// parseListenerLocation reads an entry of Locations with a Type of syslog or
+// listen. Listen is the address to listen on, and Label defaults to the Type.
+// Framing, MaxLineSize and RateLimit are optional.
+func parseListenerLocation(kind string, settings map[string]interface{}, defaults location) (location, error) {
+	listen := cast.ToString(settings["listen"])
+	network, address, err := parseListenAddress(listen)
+	if err != nil {
+		return location{}, err
+	}
+	spec := &listenerSpec{
+		network:     network,
+		address:     address,
+		format:      formatLines,
+		framing:     framingNewline,
+		maxLineSize: defaultMaxLineSize,
+		rateLimit:   cast.ToInt(settings["ratelimit"]),
+	}
+	if kind == locationSyslog {
+		spec.format = formatSyslog
+	}
+	if v, ok := settings["framing"]; ok {
+		spec.framing = cast.ToString(v)
+	}
+	if spec.framing != framingNewline && spec.framing != framingLength {
+		return location{}, errInvalidFraming
+	}
+	if v, ok := settings["maxlinesize"]; ok {
+		size, err := parseSize(cast.ToString(v))
+		if err != nil {
+			return location{}, err
+		}
+		if size > 0 {
+			spec.maxLineSize = int(size)
+		}
+	}
+
+	l := defaults
+	l.path = listen
+	l.label = cast.ToString(settings["label"])
+	if l.label == "" {
+		l.label = kind
+	}
+	l.listener = spec
+	return l, nil
+}
+
+// parseListenAddress splits an address such as udp://:5514 into its network
+// and the address on it.
+func parseListenAddress(listen string) (network, address string, err error) {
+	i := strings.Index(listen, "://")
+	if i < 0 {
+		return "", "", errInvalidListen
+	}
+	network, address = listen[:i], listen[i+3:]
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "unix", "unixgram":
+	default:
+		return "", "", errInvalidListen
+	}
+	if address == "" {
+		return "", "", errInvalidListen
+	}
+	return network, address, nil
+}
+
+// isPacket reports whether the listener receives datagrams, rather than
+// accepting connections.
+func (spec *listenerSpec) isPacket() bool {
+	return strings.HasPrefix(spec.network, "udp") || spec.network == "unixgram"
+}
+
+// startListener starts listening on the location's address, adding a source
+// for it. That source holds the messages of a syslog listener, the lines
+// sent to a line listener go to the sources of its connections. Callers hold
+// the lock.
+func (ts *tailSet) startListener(l location) error {
+	ln, err := listen(l, ts)
+	if err != nil {
+		return err
+	}
+	ts.startSource(&source{location: l, lines: ln.lines, stop: ln.stop})
+	return nil
+}
+
+// listener receives messages on an address until it is stopped.
+type listener struct {
+	location
+	tails    *tailSet
+	lines    chan *tail.Line
+	closer   io.Closer
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// listen starts listening on the location's address. A unix socket left
+// behind by an earlier run is removed first.
+func listen(l location, tails *tailSet) (*listener, error) {
+	ln := &listener{
+		location: l,
+		tails:    tails,
+		lines:    make(chan *tail.Line),
+		conns:    make(map[net.Conn]bool),
+		quit:     make(chan struct{}),
+	}
+	spec := l.listener
+	if strings.HasPrefix(spec.network, "unix") {
+		removeStaleSocket(spec.network, spec.address)
+	}
+
+	if spec.isPacket() {
+		pc, err := net.ListenPacket(spec.network, spec.address)
+		if err != nil {
+			return nil, err
+		}
+		ln.closer = pc
+		ln.wg.Add(1)
+		go ln.servePackets(pc)
+	} else {
+		sl, err := net.Listen(spec.network, spec.address)
+		if err != nil {
+			return nil, err
+		}
+		ln.closer = sl
+		ln.wg.Add(1)
+		go ln.serveStreams(sl)
+	}
+	log.Println("Listening for", spec.format, "at:", l.path)
+
+	go func() {
+		ln.wg.Wait()
+		close(ln.lines)
+	}()
+	return ln, nil
+}
+
+// removeStaleSocket removes the unix socket at path when nothing is
+// listening on it anymore.
+func removeStaleSocket(network, path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial(network, path); err == nil {
+		c.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// remoteSource is the source of a remote address sending a line listener
+// datagrams.
+type remoteSource struct {
+	*source
+	lines   chan *tail.Line
+	limiter *rateLimiter
+	done    chan struct{}
+	once    sync.Once
+	last    time.Time
+}
+
+func (r *remoteSource) close() {
+	r.once.Do(func() { close(r.done) })
+}
+
+// servePackets handles each datagram that comes in. A syslog datagram is a
+// single message, while one sent to a line listener may hold several lines.
+func (ln *listener) servePackets(pc net.PacketConn) {
+	defer ln.wg.Done()
+	remotes := make(map[string]*remoteSource)
+	defer func() {
+		for _, r := range remotes {
+			close(r.lines)
+			ln.tails.dropChild(r.source)
+		}
+	}()
+
+	buf := make([]byte, ln.listener.maxLineSize)
+	swept := time.Now()
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !ln.isStopped() {
+				log.Println("Unable to receive messages at", ln.path, err)
+			}
+			return
+		}
+		if ln.listener.format == formatSyslog {
+			if !ln.send(ln.lines, strings.TrimRight(string(buf[:n]), "\r\n\x00")) {
+				return
+			}
+			continue
+		}
+
+		now := time.Now()
+		if now.Sub(swept) > time.Minute {
+			ln.sweepRemotes(remotes, now)
+			swept = now
+		}
+		name := remoteName(addr)
+		r, ok := remotes[name]
+		if !ok {
+			if r = ln.openRemote(name); r == nil {
+				return
+			}
+			remotes[name] = r
+		}
+		r.last = now
+		for _, line := range ln.splitDatagram(buf[:n]) {
+			if !r.limiter.allow() {
+				continue
+			}
+			select {
+			case r.lines <- &tail.Line{Text: line, Time: now}:
+			case <-r.done:
+			case <-ln.quit:
+				return
+			}
+		}
+	}
+}
+
+// openRemote adds a source for a remote address that started sending us
+// datagrams, nil is returned when the listener was stopped.
+func (ln *listener) openRemote(name string) *remoteSource {
+	r := &remoteSource{lines: make(chan *tail.Line), done: make(chan struct{})}
+	r.source = ln.connectionSource(name, r.lines, r.close)
+	r.limiter = newRateLimiter(ln.listener.rateLimit, r.label)
+	if !ln.tails.addChild(ln.quit, r.source) {
+		return nil
+	}
+	log.Println("Receiving lines from", name, "at:", ln.path)
+	return r
+}
+
+// sweepRemotes removes the sources of remote addresses that stopped sending
+// us datagrams, or whose sources were stopped.
+func (ln *listener) sweepRemotes(remotes map[string]*remoteSource, now time.Time) {
+	for name, r := range remotes {
+		select {
+		case <-r.done:
+		default:
+			if now.Sub(r.last) < remoteIdleTimeout {
+				continue
+			}
+		}
+		close(r.lines)
+		ln.tails.dropChild(r.source)
+		delete(remotes, name)
+	}
+}
+
+// splitDatagram splits the datagram into the lines it holds.
+func (ln *listener) splitDatagram(b []byte) []string {
+	var lines []string
+	if ln.listener.framing == framingLength {
+		for len(b) >= 4 {
+			n := int(binary.BigEndian.Uint32(b))
+			b = b[4:]
+			if n > len(b) {
+				n = len(b)
+			}
+			lines = append(lines, strings.TrimRight(string(b[:n]), "\r\n"))
+			b = b[n:]
+		}
+		return lines
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\r\n\x00"), "\n") {
+		lines = append(lines, strings.TrimRight(line, "\r"))
+	}
+	return lines
+}
+
+// remoteName returns the address a connection or datagram came from, unix
+// sockets are often unnamed.
+func remoteName(addr net.Addr) string {
+	if addr == nil || addr.String() == "" {
+		return "unknown"
+	}
+	return addr.String()
+}
+
+// connectionSource returns the source of a connection, or of a remote
+// address, labeled by the listener's label followed by the remote address.
+func (ln *listener) connectionSource(remote string, lines <-chan *tail.Line, stop func()) *source {
+	l := ln.location
+	l.path = ln.path + string(filepath.Separator) + remote
+	l.label = ln.label + "/" + remote
+	return &source{location: l, lines: lines, stop: stop}
+}
+
+// serveStreams accepts connections until the listener is closed.
+func (ln *listener) serveStreams(sl net.Listener) {
+	defer ln.wg.Done()
+	for {
+		c, err := sl.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if !ln.isStopped() {
+				log.Println("Unable to accept connections at", ln.path, err)
+			}
+			return
+		}
+
+		ln.mu.Lock()
+		if ln.conns == nil {
+			ln.mu.Unlock()
+			c.Close()
+			return
+		}
+		ln.conns[c] = true
+		ln.wg.Add(1)
+		ln.mu.Unlock()
+		go ln.serveConn(c)
+	}
+}
+
+// serveConn sends each message read from the connection until it is closed.
+// The lines sent to a line listener go to a source of the connection's own.
+func (ln *listener) serveConn(c net.Conn) {
+	defer ln.wg.Done()
+	defer func() {
+		ln.mu.Lock()
+		delete(ln.conns, c)
+		ln.mu.Unlock()
+		c.Close()
+	}()
+
+	lines := ln.lines
+	limiter := newRateLimiter(0, "")
+	if ln.listener.format != formatSyslog {
+		remote := remoteName(c.RemoteAddr())
+		own := make(chan *tail.Line)
+		s := ln.connectionSource(remote, own, func() { c.Close() })
+		if !ln.tails.addChild(ln.quit, s) {
+			return
+		}
+		log.Println("Receiving lines from", remote, "at:", ln.path)
+		defer ln.tails.dropChild(s)
+		defer close(own)
+		lines = own
+		limiter = newRateLimiter(ln.listener.rateLimit, s.label)
+	}
+
+	br := bufio.NewReader(c)
+	for {
+		text, err := ln.readMessage(br)
+		if text != "" && limiter.allow() && !ln.send(lines, text) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !ln.isStopped() {
+				log.Println("Closing connection from", c.RemoteAddr(), "to", ln.path, err)
+			}
+			return
+		}
+	}
+}
+
+// readMessage reads the next message from a stream. A syslog message that
+// starts with a digit is preceded by its length in decimal, while a line
+// listener's framing tells whether its lines are preceded by their length.
+// Every other message ends at a newline.
+func (ln *listener) readMessage(br *bufio.Reader) (string, error) {
+	max := ln.listener.maxLineSize
+	switch {
+	case ln.listener.format == formatSyslog:
+		b, err := br.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] >= '0' && b[0] <= '9' {
+			return readOctetCounted(br, max)
+		}
+	case ln.listener.framing == framingLength:
+		return readLengthPrefixed(br, max)
+	}
+	return readLimitedLine(br, max)
+}
+
+// readOctetCounted reads a message framed as in RFC 6587, its length in
+// decimal followed by a space and the message itself. The length is read a
+// byte at a time, so a peer can't have us buffer more than its digits.
+func readOctetCounted(br *bufio.Reader, max int) (string, error) {
+	var n int64
+	for digits := 0; ; digits++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' && digits > 0 {
+			break
+		}
+		if c < '0' || c > '9' || digits == maxOctetCountDigits {
+			return "", errInvalidOctets
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if n > int64(max) {
+		return "", errFrameTooLong
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// readLengthPrefixed reads a line preceded by its length as a 4 byte big
+// endian integer. No more than max bytes of the line are kept.
+func readLengthPrefixed(br *bufio.Reader, max int) (string, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(br, prefix[:]); err != nil {
+		return "", err
+	}
+	n := int64(binary.BigEndian.Uint32(prefix[:]))
+	keep := n
+	if keep > int64(max) {
+		keep = int64(max)
+	}
+	b := make([]byte, keep)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	if _, err := io.CopyN(ioutil.Discard, br, n-keep); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// readLimitedLine reads up to the next newline, keeping no more than max
+// bytes of the line.
+func readLimitedLine(br *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		b, err := br.ReadSlice('\n')
+		if room := max - len(line); room > 0 {
+			if len(b) > room {
+				b = b[:room]
+			}
+			line = append(line, b...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimRight(string(line), "\r\n"), err
+	}
+}
+
+// send hands the message to the source, it returns false once the listener
+// is stopped.
+func (ln *listener) send(lines chan<- *tail.Line, text string) bool {
+	select {
+	case lines <- &tail.Line{Text: text, Time: time.Now()}:
+		return true
+	case <-ln.quit:
+		return false
+	}
+}
+
+func (ln *listener) isStopped() bool {
+	select {
+	case <-ln.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops listening, closing every connection that is still open. It does
+// not wait for the connections to wind down, as they remove their sources
+// from the tailSet, which holds its lock while stopping us. It is safe to
+// call more than once.
+func (ln *listener) stop() {
+	ln.stopOnce.Do(func() {
+		close(ln.quit)
+		ln.closer.Close()
+
+		ln.mu.Lock()
+		for c := range ln.conns {
+			c.Close()
+		}
+		ln.conns = nil
+		ln.mu.Unlock()
+
+		if ln.listener.network == "unixgram" {
+			os.Remove(ln.listener.address)
+		}
+	})
+}
+
+// rateLimiter drops the lines of a connection beyond limit a second, a limit
+// of 0 lets every line through.
+type rateLimiter struct {
+	limit   int
+	name    string
+	second  time.Time
+	count   int
+	dropped uint64
+}
+
+func newRateLimiter(limit int, name string) *rateLimiter {
+	return &rateLimiter{limit: limit, name: name}
+}
+
+// allow reports whether another line may go through this second.
+func (r *rateLimiter) allow() bool {
+	if r.limit <= 0 {
+		return true
+	}
+	now := time.Now().Truncate(time.Second)
+	if !now.Equal(r.second) {
+		r.second, r.count = now, 0
+	}
+	r.count++
+	if r.count <= r.limit {
+		return true
+	}
+	r.dropped++
+	if r.dropped == 1 || r.dropped%sinkReportEvery == 0 {
+		log.Println("Source", r.name, "is sending more than", r.limit, "lines a second, lines dropped so far:", r.dropped)
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+var (
+	errInvalidLocation = errors.New("each entry under Locations must either be a path, or a map containing at least a Path key or a Type of command, syslog, listen, docker or journal")
+
+	// labelColors are the ansi foreground colors handed out to sources. Red is
+	// left out on purpose so it is not mistaken for an error.
+	labelColors = []string{"32", "33", "34", "35", "36", "92", "93", "94", "95", "96"}
+)
+
+// location represents a single entry the user asked us to aggregate, along
+// with the label its lines will be prefixed with, how it is followed, how its
+// lines are parsed and grouped into events and which of those events are kept.
+type location struct {
+	path      string
+	label     string
+	options   tailOptions
+	filters   []*lineFilter
+	multiline *multilineRule
+	parser    *jsonParser
+
+	levelPatterns []*regexp.Regexp
+	minLevel      level
+	timestamps    *timestampParser
+
+	// command is set when the location is a command whose output we
+	// aggregate rather than a file.
+	command *commandSpec
+
+	// listener is set when the location is an address we receive messages
+	// on.
+	listener *listenerSpec
+
+	// docker is set when the location follows the logs of docker
+	// containers.
+	docker *dockerSpec
+
+	// journal is set when the location reads the systemd journal.
+	journal *journalSpec
+
+	// settings is what the location was configured from, it tells us
+	// whether a location changed when the config file is reloaded.
+	settings string
+}
+
+// newLocation returns a copy of defaults for the given path, the label
+// defaults to the basename of the file, or stdin for -. Patterns are left
+// without a label, each file they match is labeled by its path relative to
+// the pattern instead.
+func newLocation(path string, defaults location) location {
+	l := defaults
+	l.path = path
+	l.label = ""
+	switch {
+	case path == stdinPath:
+		l.label = "stdin"
+	case !hasMeta(path):
+		l.label = filepath.Base(path)
+	}
+	return l
+}
+
+// parseLocations takes the raw Locations value from the config file. Each
+// entry can either be a plain string (the path), or a map with a Path and an
+// optional Label key. A map with a Type of command runs a command instead, see
+// parseCommandLocation, and one with a Type of syslog or listen listens for
+// messages, see parseListenerLocation, while one with a Type of docker
+// follows the logs of docker containers, see parseDockerLocation, and one
+// with a Type of journal reads the systemd journal, see parseJournalLocation.
+// A map may also override or add to any of the settings found in defaults.
+func parseLocations(raw interface{}, defaults location) ([]location, error) {
+	entries, ok := raw.([]interface{})
+	if !ok {
+		return nil, errInvalidLocation
+	}
+
+	var locations []location
+	for _, e := range entries {
+		if path, ok := e.(string); ok {
+			locations = append(locations, newLocation(path, defaults))
+			continue
+		}
+
+		settings := lowerKeys(cast.ToStringMap(e))
+		path := cast.ToString(settings["path"])
+		kind := cast.ToString(settings["type"])
+		if path == "" && kind == "" || kind != "" && kind != locationCommand && kind != locationSyslog && kind != locationListen && kind != locationDocker && kind != locationJournal {
+			return nil, errInvalidLocation
+		}
+		configured, err := defaults.configure(settings)
+		if err != nil {
+			return nil, err
+		}
+		// The rest of the entry's keys, such as the ones of commands and
+		// listeners, apply to its location as well.
+		configured.settings += fmt.Sprint(settings)
+		switch kind {
+		case locationCommand:
+			l, err := parseCommandLocation(settings, configured)
+			if err != nil {
+				return nil, err
+			}
+			locations = append(locations, l)
+			continue
+		case locationSyslog, locationListen:
+			l, err := parseListenerLocation(kind, settings, configured)
+			if err != nil {
+				return nil, err
+			}
+			locations = append(locations, l)
+			continue
+		case locationDocker:
+			l, err := parseDockerLocation(settings, configured)
+			if err != nil {
+				return nil, err
+			}
+			locations = append(locations, l)
+			continue
+		case locationJournal:
+			l, err := parseJournalLocation(settings, configured)
+			if err != nil {
+				return nil, err
+			}
+			locations = append(locations, l)
+			continue
+		}
+		l := newLocation(path, configured)
+		if label := cast.ToString(settings["label"]); label != "" {
+			l.label = label
+		}
+		locations = append(locations, l)
+	}
+	if err := checkCommands(locations); err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// configure returns a copy of the location with the settings applied. Tail
+// options replace the ones already set, while filters are added to the ones
+// already there, so a line has to make it through both the top level filters
+// and the ones set on its entry.
+func (l location) configure(settings map[string]interface{}) (location, error) {
+	l.settings += fmt.Sprint(locationSettings(settings))
+
+	var err error
+	if l.options, err = l.options.override(settings); err != nil {
+		return l, err
+	}
+
+	filter, err := parseLineFilter(settings)
+	if err != nil {
+		return l, err
+	}
+	if !filter.empty() {
+		l.filters = append(append([]*lineFilter{}, l.filters...), filter)
+	}
+
+	if raw, ok := settings["multiline"]; ok {
+		if l.multiline, err = parseMultilineRule(raw); err != nil {
+			return l, err
+		}
+	}
+
+	if _, ok := settings["parser"]; ok {
+		if l.parser, err = parseJSONParser(settings); err != nil {
+			return l, err
+		}
+	}
+
+	if raw, ok := settings["levelpattern"]; ok {
+		if l.levelPatterns, err = compileLevelPatterns(raw); err != nil {
+			return l, err
+		}
+	}
+	if raw, ok := settings["minlevel"]; ok {
+		if l.minLevel, err = parseMinLevel(cast.ToString(raw)); err != nil {
+			return l, err
+		}
+	}
+
+	if _, ok := settings["timestamplayout"]; ok {
+		if l.timestamps, err = parseTimestampParser(settings); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+// locationKeys are the settings configure applies to a location: the tail
+// options, filters, multiline rule, parser, level and timestamp settings.
+var locationKeys = []string{
+	"reopen", "poll", "mustexist", "startat",
+	"include", "exclude", "contains", "notcontains",
+	"multiline", "parser", "template",
+	"levelpattern", "minlevel",
+	"timestamplayout", "timestamppattern",
+}
+
+// locationSettings leaves out the keys of the settings that do not apply to a
+// location, fmt prints the rest in a stable order.
+func locationSettings(settings map[string]interface{}) map[string]interface{} {
+	kept := make(map[string]interface{}, len(locationKeys))
+	for _, k := range locationKeys {
+		if v, ok := settings[k]; ok {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+// changed reports whether the location is configured any differently from
+// the one it replaces.
+func (l location) changed(old location) bool {
+	return l.path != old.path || l.label != old.label || l.settings != old.settings
+}
+
+// allows reports whether the event passes every filter of the location. When
+// a minimum level is set, events below it, or without a level, are dropped.
+func (l location) allows(e *event) bool {
+	if l.minLevel != levelUnknown && e.Level < l.minLevel {
+		return false
+	}
+	for _, f := range l.filters {
+		if !f.allows(e.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerKeys viper only lowercases the top level keys of the config file, this
+// does the same for the maps nested within Locations so Path and path are
+// treated the same.
+func lowerKeys(m map[string]interface{}) map[string]interface{} {
+	lowered := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
+
+// prefix returns what is written in front of every line that came from the
+// location. When colorize is set the label is wrapped in a color that is
+// derived from the label, so a source keeps its color across restarts.
+func (l location) prefix(colorize bool) string {
+	if !colorize {
+		return fmt.Sprintf("[%s] ", l.label)
+	}
+	return fmt.Sprintf("\x1b[%sm[%s]\x1b[0m ", labelColor(l.label), l.label)
+}
+
+// labelColor picks the color for the label, the same label always gets the
+// same color.
+func labelColor(label string) string {
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return labelColors[h.Sum32()%uint32(len(labelColors))]
+}
+
+// isTerminal reports whether the file is attached to a terminal, we only want
+// to send color codes when a person is going to be reading them.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestConfigureFingerprint(t *testing.T) {
+	base := map[string]interface{}{
+		"startat":    "end",
+		"include":    []interface{}{"ERROR"},
+		"httplisten": ":8080",
+		"logtofile":  "/tmp/out.log",
+	}
+	tests := []struct {
+		name    string
+		key     string
+		value   interface{}
+		changed bool
+	}{
+		{"http listen", "httplisten", ":9090", false},
+		{"log to file", "logtofile", "/tmp/other.log", false},
+		{"shutdown timeout", "shutdowntimeout", "30s", false},
+		{"history lines", "historylines", 10, false},
+		{"start at", "startat", "beginning", true},
+		{"filter", "include", []interface{}{"WARN"}, true},
+		{"min level", "minlevel", "warn", true},
+	}
+
+	defaults := location{options: defaultTailOptions()}
+	before, err := defaults.configure(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		settings := make(map[string]interface{}, len(base)+1)
+		for k, v := range base {
+			settings[k] = v
+		}
+		settings[test.key] = test.value
+		after, err := defaults.configure(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := after.changed(before); changed != test.changed {
+			t.Errorf("%s: got changed %v, want %v", test.name, changed, test.changed)
+		}
+	}
+}
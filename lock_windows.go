@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// lockFile does nothing on windows, where locks are not advisory and would
+// make writing to the file fail rather than wait.
+func lockFile(f *os.File) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -1,22 +1,62 @@
 package main
 
 import (
+	"bufio"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/hpcloud/tail"
 	"github.com/urfave/cli"
 )
 
 var (
-	flagLocations         cli.StringSlice
-	flagConfig            string
-	flagClearFilesOnClose bool
-	flagLogToFile         string
+	flagLocations            cli.StringSlice
+	flagConfig               string
+	flagClearFilesOnClose    bool
+	flagClearArchiveDir      string
+	flagClearArchiveCompress bool
+	flagClearDryRun          bool
+	flagLogToFile            string
+	flagDiagnosticsFile      string
+	flagTimePrefix           string
+	flagRotateSize           string
+	flagRotateInterval       time.Duration
+	flagRotateKeep           int
+	flagRotateCompress       bool
+	flagOutputFormat         string
+	flagReOpen               bool
+	flagPoll                 bool
+	flagMustExist            bool
+	flagStartAt              string
+	flagInclude              cli.StringSlice
+	flagExclude              cli.StringSlice
+	flagContains             cli.StringSlice
+	flagNotContains          cli.StringSlice
+	flagMinLevel             string
+	flagMergeWindow          time.Duration
+	flagTimestampLayout      string
+	flagStateFile            string
+	flagHTTPListen           string
+	flagHistoryLines         int
+	flagHistorySize          string
+	flagShutdownTimeout      time.Duration
+	flagRetryUnavailable     bool
+	flagCommands             cli.StringSlice
+	flagRestart              bool
+	flagSyslog               cli.StringSlice
+	flagListen               cli.StringSlice
+	flagDocker               cli.StringSlice
+	flagJournal              cli.StringSlice
+	flagJournalPriority      string
 
 	closingChannel = make(chan os.Signal, 1)
-	tailConfig     = tail.Config{Follow: true, MustExist: true}
 )
 
 func main() {
@@ -35,79 +75,496 @@ func main() {
 			Usage: "Provide a comma seperated list of strings, this tells aggregator the locations of the log files you want to aggregate.",
 			Value: &flagLocations,
 		},
+		cli.StringSliceFlag{
+			Name:  "command",
+			Usage: "Run this command line in the shell and aggregate its stdout and stderr, each labeled by the name of the command. Can be given more than once. Use - under -logFiles to aggregate our stdin.",
+			Value: &flagCommands,
+		},
+		cli.BoolFlag{
+			Name:        "restart",
+			Usage:       "Start the commands given by -command again when they exit.",
+			Destination: &flagRestart,
+		},
+		cli.StringSliceFlag{
+			Name:  "syslog",
+			Usage: "Listen for syslog messages at this address, such as udp://:5514, tcp://127.0.0.1:5514 or unix:///path/to/socket, and aggregate them. Can be given more than once.",
+			Value: &flagSyslog,
+		},
+		cli.StringSliceFlag{
+			Name:  "listen",
+			Usage: "Listen for lines sent over the network at this address, such as tcp://:9000 or udp://:9000, and aggregate them. Each connection, or address sending datagrams, is labeled by its address. Can be given more than once.",
+			Value: &flagListen,
+		},
+		cli.StringSliceFlag{
+			Name:  "docker",
+			Usage: "Follow the logs of the docker containers chosen by this, either the name of a container, project=NAME for the containers of a docker compose project, label=KEY=VALUE, or all. Can be given more than once, containers have to match one of the names and every other selector.",
+			Value: &flagDocker,
+		},
+		cli.StringSliceFlag{
+			Name:  "journal",
+			Usage: "Follow the entries of this systemd unit in the journal, or of every unit when given all. Can be given more than once.",
+			Value: &flagJournal,
+		},
+		cli.StringFlag{
+			Name:        "journal-priority",
+			Usage:       "Only aggregate the journal entries of -journal up to this priority, from emerg to debug.",
+			Destination: &flagJournalPriority,
+		},
 		cli.BoolFlag{
 			Name:        "clear",
-			Usage:       "This will clear the log files you are aggregating upon termination of this program. This is good for development, use with caution.",
+			Usage:       "This will clear the log files you are aggregating upon termination of this program, only what was read from each of them is cleared, lines written after it are kept. This is good for development, use with caution.",
 			Destination: &flagClearFilesOnClose,
 		},
+		cli.StringFlag{
+			Name:        "clear-archive-dir",
+			Usage:       "Copy what -clear clears from each log file to a file in this directory first.",
+			Destination: &flagClearArchiveDir,
+		},
+		cli.BoolFlag{
+			Name:        "clear-archive-compress",
+			Usage:       "Gzip the files -clear-archive-dir archives to.",
+			Destination: &flagClearArchiveCompress,
+		},
+		cli.BoolFlag{
+			Name:        "clear-dry-run",
+			Usage:       "Log what -clear would clear from each log file when shutting down, without clearing anything.",
+			Destination: &flagClearDryRun,
+		},
 		cli.StringFlag{
 			Name:        "logToFile",
-			Usage:       "In the event you want to have this program aggreagte logs into a single file rather than stream to the terminal, use this option to pass a string to the location where you want to log, if a file is not present at that location, we will attempt to create one.",
+			Usage:       "In the event you want to have this program aggreagte logs into a single file rather than stream to stdout, use this option to pass a string to the location where you want to log, if a file is not present at that location, we will attempt to create one.",
 			Destination: &flagLogToFile,
 		},
+		cli.StringFlag{
+			Name:        "rotate-size",
+			Usage:       "Rotate the -logToFile file once it grows past this size, such as 500KB, 100MB or 1GB.",
+			Destination: &flagRotateSize,
+		},
+		cli.DurationFlag{
+			Name:        "rotate-interval",
+			Usage:       "Rotate the -logToFile file after it has been written to for this long, such as 1h.",
+			Destination: &flagRotateInterval,
+		},
+		cli.IntFlag{
+			Name:        "rotate-keep",
+			Usage:       "How many rotated -logToFile files to keep around, the oldest are removed first. By default all of them are kept.",
+			Destination: &flagRotateKeep,
+		},
+		cli.BoolFlag{
+			Name:        "rotate-compress",
+			Usage:       "Gzip the -logToFile files once they are rotated.",
+			Destination: &flagRotateCompress,
+		},
+		cli.StringFlag{
+			Name:        "state-file",
+			Usage:       "Remember how far into each log file aggregator got in this file, so the next run picks up where this one left off. Files that were rotated or truncated in between are read from the beginning.",
+			Destination: &flagStateFile,
+		},
+		cli.StringFlag{
+			Name:        "http-listen",
+			Usage:       "Serve the aggregated lines over http at this address, such as :8080. /events streams them as Server-Sent Events, /ws over a WebSocket and / is a page for watching them from a browser.",
+			Destination: &flagHTTPListen,
+		},
+		cli.IntFlag{
+			Name:        "history-lines",
+			Usage:       "How many of the most recent lines to remember, so whoever starts following the -http-listen streams sees them first.",
+			Value:       defaultHistoryLines,
+			Destination: &flagHistoryLines,
+		},
+		cli.StringFlag{
+			Name:        "history-size",
+			Usage:       "The most text to remember for -history-lines, such as 512KB or 1MB. The oldest lines are forgotten first.",
+			Value:       "1MB",
+			Destination: &flagHistorySize,
+		},
+		cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			Usage:       "How long to wait for the lines that were read to be written and the state file to be saved when shutting down, before giving up on them. 0 waits for as long as it takes.",
+			Value:       defaultShutdownTimeout,
+			Destination: &flagShutdownTimeout,
+		},
+		cli.StringFlag{
+			Name:        "diagnostics-file",
+			Usage:       "Aggregated lines are kept apart from aggregator's own messages (starting up, shutting down, errors), which are written to stderr. Use this option to write those messages to a file instead.",
+			Destination: &flagDiagnosticsFile,
+		},
+		cli.StringFlag{
+			Name:        "time-prefix",
+			Usage:       "Prefix every aggregated line with the time it was read at, in the style of Go's time package (2006/01/02 15:04:05). By default lines are written without a time.",
+			Destination: &flagTimePrefix,
+		},
+		cli.StringFlag{
+			Name:        "output-format",
+			Usage:       "The format aggregated lines are written in, either text, or json which writes one json object per line holding the source, label, line, received time, offset and host.",
+			Value:       formatText,
+			Destination: &flagOutputFormat,
+		},
+		cli.BoolTFlag{
+			Name:        "reOpen",
+			Usage:       "Keep following a log file after it is rotated or recreated, much like tail -F. Set to false to stop aggregating a file once it is moved or removed.",
+			Destination: &flagReOpen,
+		},
+		cli.BoolFlag{
+			Name:        "poll",
+			Usage:       "Poll the log files for changes rather than relying on inotify. Useful for files on network or docker mounted file systems.",
+			Destination: &flagPoll,
+		},
+		cli.BoolTFlag{
+			Name:        "mustExist",
+			Usage:       "Refuse to start when one of the log files does not exist. Set to false to wait for the file to be created instead.",
+			Destination: &flagMustExist,
+		},
+		cli.BoolFlag{
+			Name:        "retry-unavailable",
+			Usage:       "Rather than refusing to start when one of the log files can not be tailed, aggregate the others and keep retrying it in the background.",
+			Destination: &flagRetryUnavailable,
+		},
+		cli.StringFlag{
+			Name:        "startAt",
+			Usage:       "Where to start reading each log file, either beginning, end, or the number of lines from the end of the file.",
+			Value:       startBeginning,
+			Destination: &flagStartAt,
+		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "Only aggregate lines that match this regular expression. Can be given more than once, a line is kept if it matches any of them.",
+			Value: &flagInclude,
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Drop lines that match this regular expression. Can be given more than once.",
+			Value: &flagExclude,
+		},
+		cli.StringSliceFlag{
+			Name:  "contains",
+			Usage: "Only aggregate lines that contain this text, ignoring case. A shortcut for -include when you do not need a regular expression.",
+			Value: &flagContains,
+		},
+		cli.StringSliceFlag{
+			Name:  "notContains",
+			Usage: "Drop lines that contain this text, ignoring case. A shortcut for -exclude when you do not need a regular expression.",
+			Value: &flagNotContains,
+		},
+		cli.StringFlag{
+			Name:        "min-level",
+			Usage:       "Only aggregate lines at or above this level, one of trace, debug, info, warn, error or fatal. Levels are detected in json, logfmt and [LEVEL] style lines, lines without a level are dropped.",
+			Destination: &flagMinLevel,
+		},
+		cli.DurationFlag{
+			Name:        "merge-window",
+			Usage:       "Order lines from every file by the time they were logged at, holding each line back for this long (for example 500ms) to give lines from other files a chance to arrive. Lines that arrive too late to be put in order are marked as late. Use together with -timestamp-layout.",
+			Destination: &flagMergeWindow,
+		},
+		cli.StringFlag{
+			Name:        "timestamp-layout",
+			Usage:       "The layout of the timestamp at the start of each line, in the style of Go's time package (2006-01-02 15:04:05.000) or one of the names RFC3339, RFC3339Nano, RFC1123, Stamp or StampMilli. Lines without a timestamp use the time they were read at.",
+			Destination: &flagTimestampLayout,
+		},
 	}
 	app.Action = func(c *cli.Context) error {
-		appConfig, err := newConfigFromFlags()
-		if err != nil {
-			return err
-		}
+		return aggregate(false)
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "tui",
+			Usage: "Follow the aggregated lines in an interactive view, with a sidebar to toggle each source on and off, pausing, searching and a level filter. Aggregated lines are not written to stdout or stderr in this mode.",
+			Action: func(c *cli.Context) error {
+				return aggregate(true)
+			},
+		},
+	}
+	app.Run(os.Args)
+}
 
-		signal.Notify(closingChannel, os.Interrupt)
-		appConfig.setLogOutput()
-		log.Println("Aggregator started...")
+// aggregate aggregates the log files per the flags or config file until we
+// are interrupted. When interactive is set the aggregated lines are shown in
+// the tui, rather than being written to stdout or stderr.
+func aggregate(interactive bool) error {
+	appConfig, err := newConfigFromFlags()
+	if err != nil {
+		return err
+	}
 
-		tails, err := obtainTails(appConfig.locations)
-		if err != nil {
+	signal.Notify(closingChannel, os.Interrupt, syscall.SIGTERM)
+	appConfig.setLogOutput()
+	log.Println("Aggregator started...")
+
+	files, patterns := splitLocations(appConfig.locations)
+	if interactive {
+		appConfig.sinks = fileSinks(appConfig.sinks)
+	}
+	sinks, err := openSinks(appConfig.sinks)
+	if err != nil {
+		return err
+	}
+
+	var out eventOutput = sinks
+	var stream *streamServer
+	var ui *tui
+	var h *hub
+	if appConfig.httpListen != "" || interactive {
+		h = newHub(appConfig.historyLines, int(appConfig.historySize))
+		out = outputs{sinks, h}
+	}
+	if appConfig.httpListen != "" {
+		if stream, err = startStreamServer(appConfig.httpListen, h); err != nil {
+			sinks.close()
 			return err
 		}
-
-		for _, t := range tails {
-			go tailFile(t)
+	}
+	if interactive {
+		if ui, err = startTUI(h, appConfig.locations, appConfig.diagnosticsFile == ""); err != nil {
+			if stream != nil {
+				stream.close()
+			}
+			sinks.close()
+			return err
 		}
+		// Give the terminal back should we fail to start.
+		defer ui.close()
+	}
+	var m *merger
+	if appConfig.mergeWindow > 0 {
+		m = newMerger(appConfig.mergeWindow, out)
+		out = m
+	}
+	var state *stateFile
+	if appConfig.stateFile != "" {
+		if state, err = loadStateFile(appConfig.stateFile); err != nil {
+			if stream != nil {
+				stream.close()
+			}
+			sinks.close()
+			return err
+		}
+	}
+	tails := newTailSet(out, state, appConfig.retryUnavailable)
+	if state != nil {
+		go state.run(tails)
+	}
+	err = obtainTails(files, tails)
+	if err != nil {
+		closeTails(tails)
+		return err
+	}
 
-		<-closingChannel
-
-		log.Println("Shutting down...")
+	watcher, err := watchPatterns(patterns, tails)
+	if err != nil {
 		closeTails(tails)
-		appConfig.shutdown()
+		return err
+	}
+	tails.logSummary()
+	var reloader *configReloader
+	if appConfig.config != "" {
+		reloader = watchConfigFile(appConfig.locations, tails, watcher)
+	}
 
+	stopControl := watchControlSignals(controls{
+		appConfig: appConfig,
+		tails:     tails,
+		sinks:     sinks,
+		reloader:  reloader,
+	})
+
+	<-closingChannel
+
+	if ui != nil {
+		ui.close()
+	}
+	log.Println("Shutting down...")
+	stopControl()
+	drainOrExit(appConfig.shutdownTimeout)
+	if reloader != nil {
+		reloader.close()
+	}
+	watcher.close()
+	if state != nil {
+		state.close()
+	}
+	stopped := closeTails(tails)
+	if m != nil {
+		m.close()
+	}
+	if h != nil {
+		h.close()
+	}
+	if stream != nil {
+		stream.close()
+	}
+	sinks.close()
+	appConfig.clearFiles(stopped)
+	if appConfig.clearFilesOnClose && !appConfig.clearing.dryRun {
+		// Where we are at moved to the front of the files we cleared.
+		state.record(stopped)
+	}
+	appConfig.shutdown()
+
+	return nil
+}
+
+// source ties a location to what its lines are read from, either the tail
+// that is following its file, or a stream such as the output of a command.
+// stop stops reading them, done is closed once the events of the lines read
+// before then were handed on. offset is how far into the file or stream we
+// have read, it is -1 until we know. count is how many lines were read and
+// lastRead is when the last one was read, in unix nanoseconds. identity holds
+// the fileID of the file the tail has open, as far as we know, and file is
+// that file opened by us as well, so what is left in it can still be read
+// once the tail moved on to another file. replaced is set when the source is
+// stopped because its file was replaced, the file is then left open for the
+// rest of it to be read.
+type source struct {
+	location
+	tail     *tail.Tail
+	lines    <-chan *tail.Line
+	stop     func()
+	done     chan struct{}
+	identity atomic.Value
+	file     *os.File
+	replaced int32
+	offset   int64
+	count    int64
+	lastRead int64
+}
+
+// isFile reports whether the source is a file we are tailing, rather than a
+// stream.
+func (s *source) isFile() bool {
+	return s.tail != nil
+}
+
+// advance moves the source's offset past the line that was just read and
+// returns it. The offset is counted from the lines we read, as the one
+// Tail.Tell reports may already include the line after it. Tell is used when
+// we do not know where we started, or when the count is past it because the
+// file was reopened after being rotated or truncated. Streams can only be
+// counted. When the tail moved on to another file, the lines that were
+// written to the one it had open after it moved on are returned as well,
+// along with where in that file they start.
+func (s *source) advance(text string) (offset int64, left []string, leftAt int64) {
+	prev := atomic.LoadInt64(&s.offset)
+	offset = prev + int64(len(text)) + 1
+	if s.isFile() {
+		tell, _ := s.tail.Tell()
+		if prev < 0 || tell > 0 && offset > tell {
+			if prev >= 0 {
+				// The file was reopened or truncated, it may be
+				// another file now.
+				if old := s.identify(); old != nil {
+					left, _ = readRest(old, prev, true)
+					leftAt = prev
+					old.Close()
+				}
+			}
+			offset = tell
+		}
+	}
+	atomic.StoreInt64(&s.offset, offset)
+	atomic.AddInt64(&s.count, 1)
+	atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+	return offset, left, leftAt
+}
+
+// identify records the identity of the file at the source's path as the one
+// the source is reading, and opens it. When that is another file than the
+// one that was open, the one that was open is returned for the caller to
+// read what is left in it and close it.
+func (s *source) identify() (previous *os.File) {
+	f, err := os.Open(s.path)
+	if err != nil {
 		return nil
 	}
-	app.Run(os.Args)
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil
+	}
+	id, ok := identify(fi)
+	if !ok {
+		f.Close()
+		return nil
+	}
+	if s.file != nil && s.identity.Load() == id {
+		f.Close()
+		return nil
+	}
+	s.identity.Store(id)
+	previous, s.file = s.file, f
+	return previous
+}
+
+// finish closes the file the source opened once it has stopped, unless the
+// source was replaced, then it is left for the rest of it to be read.
+func (s *source) finish() {
+	if s.file != nil && atomic.LoadInt32(&s.replaced) == 0 {
+		s.file.Close()
+	}
+}
+
+// readRest returns the lines in f from offset on, and where the last of them
+// ends. A last line that has no newline yet is only included when partial is
+// set.
+func readRest(f *os.File, offset int64, partial bool) (lines []string, end int64) {
+	end = offset
+	br := bufio.NewReader(io.NewSectionReader(f, offset, math.MaxInt64-offset))
+	for {
+		text, err := br.ReadString('\n')
+		if err == nil || text != "" && partial {
+			lines = append(lines, strings.TrimSuffix(text, "\n"))
+			end += int64(len(text))
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Unable to read the rest of", f.Name(), err)
+			}
+			return lines, end
+		}
+	}
 }
 
-// obtainTails provided a slice of strings (that is used to represent the
-// locations of log files you wish to aggregate). Will return a matching
-// tail.Tail slice where each value in the slice is mapped from the argumented
-// locations.
-func obtainTails(locations []string) ([]*tail.Tail, error) {
-	var tails []*tail.Tail
+// consumed returns how far into the file we have read, or -1 when we do not
+// know yet.
+func (s *source) consumed() int64 {
+	return atomic.LoadInt64(&s.offset)
+}
+
+// obtainTails provided a slice of locations (that is used to represent the
+// log files you wish to aggregate). Will start tailing each one of them,
+// adding them to the argumented tailSet. Unless the tailSet retries the ones
+// that are unavailable, the first one that can not be tailed is returned.
+func obtainTails(locations []location, tails *tailSet) error {
 	for _, l := range locations {
-		t, err := tail.TailFile(l, tailConfig)
+		err := tails.addOrRetry(l)
 		if err != nil {
-			log.Println("There was an issue while attmpting to aggregate log file located at:", l)
-			return nil, err
+			log.Println("There was an issue while attmpting to aggregate log file located at:", l.path)
+			if !tails.retryUnavailable {
+				return err
+			}
+			log.Println(err)
 		}
-		tails = append(tails, t)
 	}
-	return tails, nil
+	return nil
 }
 
 // tailFile depends on the tail package, it essentially polls the file it
-// is supposed to log, writing the data to the corresponding log location.
-func tailFile(tail *tail.Tail) {
-	for line := range tail.Lines {
-		log.Println(line.Text)
+// is supposed to log, grouping its lines into events when the source has a
+// multiline rule. Events that make it through the source's filters are handed
+// to out, each one in a single write so they are never interleaved.
+func tailFile(s *source, out eventOutput) {
+	for e := range s.multiline.assemble(readEvents(s)) {
+		if !s.allows(e) {
+			continue
+		}
+		out.write(s, e)
 	}
 }
 
 // closeTails should be called after the program is interrupted. Upon recieving
-// this signal it will range over the tails argument. Tails represents the
-// *tail.Tail pointer that is created for each and every file being tailed.
-func closeTails(tails []*tail.Tail) {
+// this signal it will stop every tail within the tails argument, which holds
+// the *tail.Tail pointer that is created for each and every file being tailed,
+// and wait for the lines they already read to be handed on, returning the
+// sources that were stopped.
+func closeTails(tails *tailSet) []*source {
 	log.Println("Attempting to close aggregator")
-	for _, t := range tails {
-		t.Stop()
-		t.Cleanup()
-	}
+	return tails.stopAll()
 }
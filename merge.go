@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// eventOutput is anything the events of a source can be handed to once they
+// made it through the source's filters.
+type eventOutput interface {
+	write(s *source, e *event)
+}
+
+// pendingEvent is an event held back by the merger, along with the source it
+// came from.
+type pendingEvent struct {
+	source *source
+	event  *event
+}
+
+// mergeHeap orders pending events by the time they were logged at, events
+// logged at the same time keep the order they were received in.
+type mergeHeap []pendingEvent
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].event.Timestamp.Equal(h[j].event.Timestamp) {
+		return h[i].event.Received.Before(h[j].event.Received)
+	}
+	return h[i].event.Timestamp.Before(h[j].event.Timestamp)
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(pendingEvent)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// merger orders the events of every source by the time they were logged at.
+// Each event is held for the length of the window, giving events from other
+// sources that were logged before it a chance to arrive. Events that arrive
+// after an event logged later than them was already written are marked late
+// and written straight away.
+type merger struct {
+	mu      sync.Mutex
+	window  time.Duration
+	out     eventOutput
+	pending mergeHeap
+	last    time.Time
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newMerger starts a merger that writes the ordered events to out.
+func newMerger(window time.Duration, out eventOutput) *merger {
+	m := &merger{window: window, out: out, done: make(chan struct{}), stopped: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+// write adds the event to the ones waiting to be written.
+func (m *merger) write(s *source, e *event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.Timestamp.IsZero() {
+		e.Timestamp = e.Received
+	}
+	if e.Timestamp.Before(m.last) {
+		e.Late = true
+		m.out.write(s, e)
+		return
+	}
+	heap.Push(&m.pending, pendingEvent{source: s, event: e})
+}
+
+// run writes out the events that have waited for the length of the window,
+// checking ten times per window.
+func (m *merger) run() {
+	defer close(m.stopped)
+	interval := m.window / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flush(time.Now().Add(-m.window))
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// flush writes, in order, the events at the front of the queue that were
+// received before the cutoff.
+func (m *merger) flush(cutoff time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.pending) > 0 && !m.pending[0].event.Received.After(cutoff) {
+		p := heap.Pop(&m.pending).(pendingEvent)
+		m.last = p.event.Timestamp
+		m.out.write(p.source, p.event)
+	}
+}
+
+// close stops the merger and writes out every event it was still holding.
+func (m *merger) close() {
+	close(m.done)
+	<-m.stopped
+	m.flush(time.Now().Add(m.window))
+}
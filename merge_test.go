@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergerOrdersEvents(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return base.Add(time.Duration(seconds) * time.Second) }
+
+	tests := []struct {
+		name string
+		// Each event is its timestamp and when it was received, in seconds
+		// from base, a timestamp below 0 means the event has none.
+		events [][2]int
+		want   []string
+	}{
+		{
+			name:   "in order",
+			events: [][2]int{{1, 1}, {2, 2}, {3, 3}},
+			want:   []string{"0", "1", "2"},
+		},
+		{
+			name:   "out of order",
+			events: [][2]int{{3, 1}, {1, 2}, {2, 3}},
+			want:   []string{"1", "2", "0"},
+		},
+		{
+			name:   "same timestamp in the order received",
+			events: [][2]int{{5, 3}, {5, 1}, {5, 2}},
+			want:   []string{"1", "2", "0"},
+		},
+		{
+			name:   "without a timestamp",
+			events: [][2]int{{4, 4}, {-1, 2}, {3, 3}},
+			want:   []string{"1", "2", "0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := make(eventChan, len(test.events))
+			m := newMerger(time.Hour, out)
+			for i, ts := range test.events {
+				e := &event{Text: string(rune('0' + i)), Received: at(ts[1])}
+				if ts[0] >= 0 {
+					e.Timestamp = at(ts[0])
+				}
+				m.write(nil, e)
+			}
+			if len(out) > 0 {
+				t.Fatal("events were written before the window passed")
+			}
+			m.close()
+
+			for _, want := range test.want {
+				if e := out.next(t); e.Text != want || e.Late {
+					t.Errorf("got event %s (late %v), want %s", e.Text, e.Late, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergerMarksLateEvents(t *testing.T) {
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	out := make(eventChan, 3)
+	m := newMerger(time.Hour, out)
+	defer m.close()
+
+	m.write(nil, &event{Text: "first", Timestamp: base.Add(2 * time.Second), Received: base})
+	m.flush(base)
+	if e := out.next(t); e.Text != "first" {
+		t.Fatalf("got %s, want first", e.Text)
+	}
+
+	m.write(nil, &event{Text: "late", Timestamp: base.Add(time.Second), Received: base})
+	if e := out.next(t); e.Text != "late" || !e.Late {
+		t.Errorf("got %s (late %v), want it written at once and marked late", e.Text, e.Late)
+	}
+
+	m.write(nil, &event{Text: "on time", Timestamp: base.Add(3 * time.Second), Received: base.Add(time.Minute)})
+	m.flush(base)
+	if len(out) > 0 {
+		t.Errorf("got %s, which was received after the cutoff", (<-out).Text)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	defaultMultilineTimeout  = time.Second
+	defaultMultilineMaxLines = 500
+)
+
+var errInvalidMultiline = errors.New("Multiline must have exactly one of Start or Continuation set")
+
+// multilineRule groups lines that belong to the same event, such as a stack
+// trace, so they are written out together. Either start matches the first
+// line of every event, or continuation matches every line that belongs to
+// the event before it. An event is written once the next one starts, or once
+// timeout passes without a new line so the last event is not held forever.
+type multilineRule struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	timeout      time.Duration
+	maxLines     int
+}
+
+// parseMultilineRule builds a multilineRule from the Start, Continuation,
+// Timeout and MaxLines keys of the Multiline setting. A nil rule is returned
+// when the setting is not present.
+func parseMultilineRule(raw interface{}) (*multilineRule, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	settings := lowerKeys(cast.ToStringMap(raw))
+	start := cast.ToString(settings["start"])
+	continuation := cast.ToString(settings["continuation"])
+	if (start == "") == (continuation == "") {
+		return nil, errInvalidMultiline
+	}
+
+	r := &multilineRule{timeout: defaultMultilineTimeout, maxLines: defaultMultilineMaxLines}
+	var err error
+	if start != "" {
+		r.start, err = regexp.Compile(start)
+	} else {
+		r.continuation, err = regexp.Compile(continuation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := settings["timeout"]; ok {
+		r.timeout = cast.ToDuration(v)
+	}
+	if v, ok := settings["maxlines"]; ok {
+		r.maxLines = cast.ToInt(v)
+	}
+	return r, nil
+}
+
+// continues reports whether text belongs to the event that came before it.
+func (r *multilineRule) continues(text string) bool {
+	if r.start != nil {
+		return !r.start.MatchString(text)
+	}
+	return r.continuation.MatchString(text)
+}
+
+// assemble reads lines until the channel is closed, sending each group of
+// lines on the returned channel as a single event whose text holds every line
+// of the group. Without a rule every line is its own event.
+func (r *multilineRule) assemble(lines <-chan *event) <-chan *event {
+	if r == nil {
+		return lines
+	}
+
+	events := make(chan *event)
+	go func() {
+		defer close(events)
+		var pending *event
+		var count int
+		timer := time.NewTimer(r.timeout)
+		timer.Stop()
+		flush := func() {
+			if pending != nil {
+				events <- pending
+				pending = nil
+			}
+		}
+
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					flush()
+					return
+				}
+				if pending != nil && count < r.maxLines && r.continues(line.Text) {
+					pending.Text += "\n" + line.Text
+					pending.Offset = line.Offset
+					count++
+				} else {
+					flush()
+					pending = line
+					count = 1
+				}
+				timer.Reset(r.timeout)
+			case <-timer.C:
+				flush()
+			}
+		}
+	}()
+	return events
+}
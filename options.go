@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/hpcloud/tail"
+	"github.com/spf13/cast"
+)
+
+const (
+	startBeginning = "beginning"
+	startEnd       = "end"
+)
+
+var errInvalidStart = errors.New("StartAt must either be beginning, end or the number of lines from the end of the file to start at")
+
+// tailOptions controls how a single location is followed. They can be set
+// for every location at once, and overridden per entry under Locations.
+type tailOptions struct {
+	reOpen    bool
+	poll      bool
+	mustExist bool
+	start     string
+}
+
+// defaultTailOptions behaves like tail -F, reading each file from the
+// beginning and following it across rotations.
+func defaultTailOptions() tailOptions {
+	return tailOptions{reOpen: true, mustExist: true, start: startBeginning}
+}
+
+// override returns a copy of the options with any of the ReOpen, Poll,
+// MustExist and StartAt keys within settings applied on top. The keys are
+// expected to be lowercased already.
+func (o tailOptions) override(settings map[string]interface{}) (tailOptions, error) {
+	if v, ok := settings["reopen"]; ok {
+		o.reOpen = cast.ToBool(v)
+	}
+	if v, ok := settings["poll"]; ok {
+		o.poll = cast.ToBool(v)
+	}
+	if v, ok := settings["mustexist"]; ok {
+		o.mustExist = cast.ToBool(v)
+	}
+	if v, ok := settings["startat"]; ok {
+		o.start = cast.ToString(v)
+		if err := validateStart(o.start); err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+// validateStart makes sure a start position is one we know how to seek to.
+func validateStart(start string) error {
+	switch start {
+	case startBeginning, startEnd:
+		return nil
+	}
+	n, err := strconv.Atoi(start)
+	if err != nil || n < 0 {
+		return errInvalidStart
+	}
+	return nil
+}
+
+// tailConfig builds the config the tail package uses to follow the file at
+// path. Messages from the tail package, such as a file being reopened after
+// it was rotated, are written to our own log.
+func (o tailOptions) tailConfig(path string) tail.Config {
+	c := tail.Config{
+		Follow:    true,
+		ReOpen:    o.reOpen,
+		Poll:      o.poll,
+		MustExist: o.mustExist,
+		Logger:    log.New(stdLogWriter{}, "", 0),
+	}
+
+	switch o.start {
+	case startBeginning, "":
+	case startEnd:
+		c.Location = &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}
+	default:
+		n, _ := strconv.Atoi(o.start)
+		offset, err := lastLinesOffset(path, n)
+		if err != nil {
+			log.Println("Unable to find the last", n, "lines of", path, "starting at the beginning instead")
+			break
+		}
+		c.Location = &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+	}
+	return c
+}
+
+// lastLinesOffset reads the file at path backwards, returning the offset the
+// last n lines start at. A trailing newline does not count as a line.
+func lastLinesOffset(path string, n int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := fi.Size()
+	if n == 0 {
+		return end, nil
+	}
+
+	buf := make([]byte, 4096)
+	offset := end
+	for offset > 0 {
+		size := int64(len(buf))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := f.ReadAt(buf[:size], offset); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			if buf[i] != '\n' || offset+i == end-1 {
+				continue
+			}
+			n--
+			if n == 0 {
+				return offset + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// stdLogWriter hands everything written to it to the standard logger, so
+// other packages that want a logger end up in the same place we log to.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
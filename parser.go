@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/spf13/cast"
+)
+
+const parserJSON = "json"
+
+var errInvalidParser = errors.New("the only Parser currently supported is json")
+
+// jsonParser renders lines that hold a json object into something a person
+// can read. The fields named in the template are rendered by it, every other
+// field is added after it as key=value. Lines that are not a json object are
+// left as they are.
+type jsonParser struct {
+	template *template.Template
+	named    map[string]bool
+}
+
+// parseJSONParser builds a jsonParser from the Parser and Template settings.
+// A nil parser is returned when Parser is not set.
+func parseJSONParser(settings map[string]interface{}) (*jsonParser, error) {
+	kind := cast.ToString(settings["parser"])
+	if kind == "" {
+		return nil, nil
+	}
+	if kind != parserJSON {
+		return nil, errInvalidParser
+	}
+
+	p := &jsonParser{named: make(map[string]bool)}
+	text := cast.ToString(settings["template"])
+	if text == "" {
+		return p, nil
+	}
+	t, err := template.New("line").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	p.template = t
+	collectFields(t.Tree.Root, p.named)
+	return p, nil
+}
+
+// parse decodes the text, returning the fields and the rendered line. ok is
+// false when the text is not a json object.
+func (p *jsonParser) parse(text string) (map[string]interface{}, string, bool) {
+	if p == nil || !strings.HasPrefix(strings.TrimSpace(text), "{") {
+		return nil, text, false
+	}
+
+	var fields map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(text))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return nil, text, false
+	}
+
+	var b bytes.Buffer
+	if p.template != nil {
+		// Fields the template asks for that are missing from this line are
+		// set to an empty string, otherwise they render as <no value>.
+		data := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			data[k] = v
+		}
+		for k := range p.named {
+			if _, ok := data[k]; !ok {
+				data[k] = ""
+			}
+		}
+		if err := p.template.Execute(&b, data); err != nil {
+			return nil, text, false
+		}
+		trimmed := strings.TrimSpace(b.String())
+		b.Reset()
+		b.WriteString(trimmed)
+	}
+
+	var rest []string
+	for k := range fields {
+		if !p.named[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%s", k, formatValue(fields[k]))
+	}
+	return fields, b.String(), true
+}
+
+// formatValue renders a field value for a key=value pair. Strings are only
+// quoted when they would otherwise be ambiguous, everything else is written
+// as json.
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// collectFields walks the parsed template, adding the name of every top
+// level field it refers to, such as msg for {{.msg}}, to named.
+func collectFields(node parse.Node, named map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectFields(c, named)
+		}
+	case *parse.ActionNode:
+		collectFields(n.Pipe, named)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			collectFields(c, named)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			collectFields(a, named)
+		}
+	case *parse.FieldNode:
+		named[n.Ident[0]] = true
+	case *parse.IfNode:
+		collectFields(n.Pipe, named)
+		collectFields(n.List, named)
+		collectFields(n.ElseList, named)
+	case *parse.RangeNode:
+		collectFields(n.Pipe, named)
+		collectFields(n.List, named)
+		collectFields(n.ElseList, named)
+	case *parse.WithNode:
+		collectFields(n.Pipe, named)
+		collectFields(n.List, named)
+		collectFields(n.ElseList, named)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns the arguments that run the command line in the shell.
+func shellCommand(line string) []string {
+	return []string{"/bin/sh", "-c", line}
+}
+
+// setProcessGroup puts the command in a process group of its own. It is not
+// sent the signals meant for us, such as Ctrl-C in a terminal, and it can be
+// stopped along with the processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcess asks the command's process group to exit.
+func terminateProcess(cmd *exec.Cmd) {
+	if cmd != nil && cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+}
+
+// killProcess kills the command's process group.
+func killProcess(cmd *exec.Cmd) {
+	if cmd != nil && cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os/exec"
+
+// shellCommand returns the arguments that run the command line in the shell.
+func shellCommand(line string) []string {
+	return []string{"cmd", "/C", line}
+}
+
+// setProcessGroup does nothing on windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcess kills the command, windows has no way of asking it to
+// exit.
+func terminateProcess(cmd *exec.Cmd) {
+	killProcess(cmd)
+}
+
+// killProcess kills the command.
+func killProcess(cmd *exec.Cmd) {
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
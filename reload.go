@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// configReloadDelay is how long we wait for the config file to settle before
+// reloading it, editors tend to write a file more than once when saving it.
+const configReloadDelay = 200 * time.Millisecond
+
+// configReloader applies changes to the Locations of the config file while we
+// are running. Files and patterns that were added are tailed, the ones that
+// were removed are stopped, and the ones whose settings changed are restarted
+// with the new settings from where they were. Other settings take effect the
+// next time aggregator is started.
+type configReloader struct {
+	mu        sync.Mutex
+	path      string
+	tails     *tailSet
+	watcher   *patternWatcher
+	locations []location
+	timer     *time.Timer
+	closed    bool
+}
+
+// watchConfigFile reloads the config file viper read in whenever it changes.
+// locations are the ones we started out with.
+func watchConfigFile(locations []location, tails *tailSet, watcher *patternWatcher) *configReloader {
+	r := &configReloader{
+		path:      viper.ConfigFileUsed(),
+		tails:     tails,
+		watcher:   watcher,
+		locations: locations,
+	}
+	viper.OnConfigChange(func(fsnotify.Event) {
+		r.schedule()
+	})
+	viper.WatchConfig()
+	return r
+}
+
+// schedule reloads the config file once it has not changed for
+// configReloadDelay.
+func (r *configReloader) schedule() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.timer == nil {
+		r.timer = time.AfterFunc(configReloadDelay, r.reload)
+		return
+	}
+	r.timer.Reset(configReloadDelay)
+}
+
+// reload reads the config file and applies the changes to its Locations. A
+// config file that can not be read or holds invalid Locations is ignored,
+// leaving everything as it was.
+func (r *configReloader) reload() {
+	v := viper.New()
+	v.SetConfigFile(r.path)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		log.Println("Ignoring the change to the config file, it could not be read:", err)
+		return
+	}
+	locations, err := configLocations(v.AllSettings(), v.Get("Locations"))
+	if err != nil {
+		log.Println("Ignoring the change to the config file, its Locations are invalid:", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	log.Println("Reloading the locations of the config file:", r.path)
+	r.applyFiles(locations)
+	r.applyPatterns(locations)
+	r.locations = locations
+}
+
+// close stops applying changes to the config file, viper keeps watching it
+// but its changes are ignored.
+func (r *configReloader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// applyFiles starts, stops and restarts the tails of the locations that are
+// single files.
+func (r *configReloader) applyFiles(locations []location) {
+	oldFiles, _ := splitLocations(r.locations)
+	newFiles, _ := splitLocations(locations)
+
+	old := make(map[string]location, len(oldFiles))
+	for _, l := range oldFiles {
+		old[l.path] = l
+	}
+	for _, l := range newFiles {
+		prev, ok := old[l.path]
+		delete(old, l.path)
+		switch {
+		case !ok:
+			log.Println("Started aggregating log file:", l.path)
+			if err := r.tails.addOrRetry(l); err != nil {
+				log.Println("There was an issue while attmpting to aggregate log file located at:", l.path)
+				log.Println(err)
+			}
+		case l.changed(prev):
+			log.Println("Applying the new settings of log file:", l.path)
+			if err := r.tails.replace(l); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	for path := range old {
+		r.tails.remove(path)
+	}
+}
+
+// applyPatterns hands the patterns to the watcher, tails the files matching
+// the ones that are new, restarts the tails of files matching the ones that
+// changed and stops the ones that no pattern matches anymore.
+func (r *configReloader) applyPatterns(locations []location) {
+	_, oldPatterns := splitLocations(r.locations)
+	newFiles, newPatterns := splitLocations(locations)
+	r.watcher.setPatterns(newPatterns)
+
+	old := make(map[string]globPattern, len(oldPatterns))
+	for _, p := range oldPatterns {
+		old[p.path] = p
+	}
+	for _, p := range newPatterns {
+		prev, ok := old[p.path]
+		delete(old, p.path)
+		switch {
+		case !ok:
+			log.Println("Started watching for log files matching:", p.path)
+			if err := r.watcher.scan(p, p.root); err != nil {
+				log.Println("There was an issue while attmpting to watch the directory:", p.root)
+				log.Println(err)
+			}
+		case p.changed(prev.location):
+			log.Println("Applying the new settings of log files matching:", p.path)
+			for _, s := range r.tails.list() {
+				if p.matches(s.path) {
+					if err := r.tails.replace(p.match(s.path)); err != nil {
+						log.Println(err)
+					}
+				}
+			}
+		}
+	}
+
+	if len(old) == 0 {
+		return
+	}
+	kept := make(map[string]bool, len(newFiles))
+	for _, l := range newFiles {
+		kept[l.path] = true
+	}
+	for _, s := range r.tails.list() {
+		if kept[s.path] || matchedBy(newPatterns, s.path) || !matchedBy(oldPatterns, s.path) {
+			continue
+		}
+		r.tails.remove(s.path)
+	}
+}
+
+// matchedBy reports whether one of the patterns matches the path.
+func matchedBy(patterns []globPattern, path string) bool {
+	for _, p := range patterns {
+		if p.matches(path) {
+			return true
+		}
+	}
+	return false
+}
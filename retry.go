@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = time.Minute
+)
+
+// pendingSource is a location whose file could not be tailed, it is retried
+// in the background, waiting twice as long after every failed attempt up to
+// retryMaxBackoff.
+type pendingSource struct {
+	location
+	err      error
+	since    time.Time
+	attempts int
+	backoff  time.Duration
+	next     time.Time
+	timer    *time.Timer
+}
+
+// addOrRetry starts tailing the location. When its file can not be tailed
+// the error is returned, and when retrying is enabled on the set it is
+// retried in the background until it can be.
+func (ts *tailSet) addOrRetry(l location) error {
+	err := ts.add(l)
+	if err == nil || !ts.retryUnavailable {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.pending[l.path]; ok || ts.closed {
+		return err
+	}
+	p := &pendingSource{location: l, err: err, since: time.Now(), attempts: 1, backoff: retryMinBackoff}
+	ts.pending[l.path] = p
+	ts.schedule(p)
+	return err
+}
+
+// schedule retries the pending source once its backoff has passed. Callers
+// hold the lock.
+func (ts *tailSet) schedule(p *pendingSource) {
+	p.next = time.Now().Add(p.backoff)
+	p.timer = time.AfterFunc(p.backoff, func() {
+		ts.retry(p)
+	})
+}
+
+// retry tries to tail the pending source again, unless it was removed or the
+// set was stopped in the meantime.
+func (ts *tailSet) retry(p *pendingSource) {
+	ts.mu.Lock()
+	if ts.pending[p.path] != p || ts.closed {
+		ts.mu.Unlock()
+		return
+	}
+	ts.mu.Unlock()
+
+	err := ts.add(p.location)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.pending[p.path] != p || ts.closed {
+		return
+	}
+	p.attempts++
+	if err == nil {
+		delete(ts.pending, p.path)
+		log.Println("Started aggregating log file that was unavailable, after", p.attempts, "attempts:", p.path)
+		return
+	}
+	if err.Error() != p.err.Error() {
+		log.Println("Log file is still unavailable:", p.path, err)
+	}
+	p.err = err
+	if p.backoff *= 2; p.backoff > retryMaxBackoff {
+		p.backoff = retryMaxBackoff
+	}
+	ts.schedule(p)
+}
+
+// forgetPending stops retrying the file at path, along with any files
+// beneath it in the event path is a directory. Callers hold the lock.
+func (ts *tailSet) forgetPending(path string) {
+	for pp, p := range ts.pending {
+		if pp == path || isWithin(path, pp) {
+			p.timer.Stop()
+			delete(ts.pending, pp)
+		}
+	}
+}
+
+// unavailable returns the sources that are waiting to be retried, ordered by
+// their path.
+func (ts *tailSet) unavailable() []*pendingSource {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	pending := make([]*pendingSource, 0, len(ts.pending))
+	for _, p := range ts.pending {
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].path < pending[j].path })
+	return pending
+}
+
+// status describes why the source is unavailable and when it is retried.
+func (p *pendingSource) status() string {
+	return fmt.Sprintf("[%s] %s: unavailable for %s after %d attempts, retrying in %s: %s",
+		p.label, p.path, time.Since(p.since).Round(time.Second), p.attempts,
+		time.Until(p.next).Round(time.Second), p.err)
+}
+
+// logSummary logs how many log files we are aggregating, along with each of
+// the ones that are unavailable.
+func (ts *tailSet) logSummary() {
+	tailed := len(ts.list())
+	pending := ts.unavailable()
+	if len(pending) == 0 {
+		log.Println("Aggregating", tailed, "sources")
+		return
+	}
+	log.Println("Aggregating", tailed, "sources,", len(pending), "log files are unavailable and retried in the background")
+	for _, p := range pending {
+		log.Println(p.status())
+	}
+}
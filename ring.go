@@ -0,0 +1,65 @@
+package main
+
+const (
+	defaultHistoryLines = 1000
+	defaultHistorySize  = 1 << 20
+)
+
+// eventRing holds the most recent events, at most maxLines of them and at
+// most maxBytes of their text. The oldest events are dropped first to make
+// room for new ones. It is not safe for concurrent use, the hub guards it.
+type eventRing struct {
+	events   []pendingEvent
+	start    int
+	count    int
+	bytes    int
+	maxBytes int
+}
+
+// newEventRing returns an empty ring, a maxLines or maxBytes of 0 or less
+// keeps nothing.
+func newEventRing(maxLines, maxBytes int) *eventRing {
+	if maxLines < 0 {
+		maxLines = 0
+	}
+	return &eventRing{events: make([]pendingEvent, maxLines), maxBytes: maxBytes}
+}
+
+// add adds the event to the ring, dropping the oldest events it no longer
+// has room for. An event larger than maxBytes on its own is not kept.
+func (r *eventRing) add(src *source, e *event) {
+	size := len(e.Text)
+	if len(r.events) == 0 || r.maxBytes <= 0 || size > r.maxBytes {
+		return
+	}
+	for r.count > 0 && (r.count == len(r.events) || r.bytes+size > r.maxBytes) {
+		r.dropOldest()
+	}
+	r.events[(r.start+r.count)%len(r.events)] = pendingEvent{source: src, event: e}
+	r.count++
+	r.bytes += size
+}
+
+// dropOldest removes the oldest event from the ring.
+func (r *eventRing) dropOldest() {
+	r.bytes -= len(r.events[r.start].event.Text)
+	r.events[r.start] = pendingEvent{}
+	r.start = (r.start + 1) % len(r.events)
+	r.count--
+}
+
+// recent returns the newest limit events the filter wants, oldest first. A
+// limit below 0 returns all of them.
+func (r *eventRing) recent(f eventFilter, limit int) []*event {
+	var events []*event
+	for i := r.count - 1; i >= 0 && (limit < 0 || len(events) < limit); i-- {
+		p := r.events[(r.start+i)%len(r.events)]
+		if f.wants(p.source, p.event) {
+			events = append(events, p.event)
+		}
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
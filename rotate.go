@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// rotatedLayout is the suffix a rotated file is given, it sorts in the order
+// the files were rotated in.
+const rotatedLayout = "2006-01-02T15-04-05.000"
+
+var (
+	errInvalidSize = errors.New("sizes must be a number of bytes, optionally followed by KB, MB or GB")
+
+	sizeUnits = []struct {
+		suffix string
+		bytes  int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+)
+
+// rotation decides when a file we write to is rotated, and what happens to
+// the files that were rotated out. A zero rotation never rotates.
+type rotation struct {
+	maxSize  int64
+	interval time.Duration
+	keep     int
+	compress bool
+}
+
+// parseRotation reads the RotateSize, RotateInterval, RotateKeep and
+// RotateCompress keys within settings. The keys are expected to be
+// lowercased already.
+func parseRotation(settings map[string]interface{}) (rotation, error) {
+	var r rotation
+	var err error
+	if v, ok := settings["rotatesize"]; ok {
+		if r.maxSize, err = parseSize(cast.ToString(v)); err != nil {
+			return r, err
+		}
+	}
+	r.interval = cast.ToDuration(settings["rotateinterval"])
+	r.keep = cast.ToInt(settings["rotatekeep"])
+	r.compress = cast.ToBool(settings["rotatecompress"])
+	return r, nil
+}
+
+// parseSize parses sizes such as 512KB, 100MB or 1GB, a plain number is a
+// number of bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiplier = u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errInvalidSize
+	}
+	return n * multiplier, nil
+}
+
+// rotatingFile is a file that is appended to, and moved aside once it grows
+// past maxSize or has been written to for longer than interval. Rotating
+// happens between two writes while holding the same lock as writing, so no
+// line is lost or written twice. Rotated files are compressed in the
+// background when compress is set, and only the newest keep of them are
+// kept around when keep is set.
+type rotatingFile struct {
+	rotation
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+	wg     sync.WaitGroup
+}
+
+// openRotatingFile opens the file at path for appending, creating it if it is
+// not there yet.
+func openRotatingFile(path string, r rotation) (*rotatingFile, error) {
+	rf := &rotatingFile{rotation: r, path: path}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the file at the path, picking up where its size was.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = fi.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+// Write writes p to the file, rotating it first when p would take it past
+// the max size or when the interval has passed.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.due(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			log.Println("Unable to rotate", rf.path, err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file should be rotated before writing n more bytes
+// to it. An empty file is never rotated.
+func (rf *rotatingFile) due(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.interval > 0 && time.Since(rf.opened) >= rf.interval
+}
+
+// rotate moves the current file aside and opens a new one in its place.
+func (rf *rotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().Format(rotatedLayout)
+	if _, err := os.Stat(rotated); err == nil {
+		// We already rotated within this millisecond, the next write will
+		// try again rather than overwriting that file.
+		return nil
+	}
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+	if err := os.Rename(rf.path, rotated); err != nil {
+		// Keep writing to the file we have rather than losing lines.
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		if rf.compress {
+			if err := compressFile(rotated); err != nil {
+				log.Println("Unable to compress", rotated, err)
+			}
+		}
+		rf.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files, leaving the newest keep of them.
+func (rf *rotatingFile) prune() {
+	if rf.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+
+	var rotated []string
+	prefix := rf.path + "."
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, prefix), ".gz")
+		if _, err := time.Parse(rotatedLayout, stamp); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > rf.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			log.Println("Unable to remove rotated file", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// reopen closes the file and opens the file at the path again. Once the file
+// was moved aside by someone else, such as logrotate, we carry on writing to
+// a new file at the path.
+func (rf *rotatingFile) reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+	return rf.open()
+}
+
+// Close closes the file, waiting for any rotated files that are still being
+// compressed.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	rf.mu.Unlock()
+	rf.wg.Wait()
+	return err
+}
+
+// compressFile gzips the file at path into path.gz, removing the original
+// once the compressed copy is complete.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
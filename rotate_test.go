@@ -0,0 +1,128 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input string
+		size  int64
+		err   error
+	}{
+		{"", 0, nil},
+		{"512", 512, nil},
+		{"100B", 100, nil},
+		{"512KB", 512 << 10, nil},
+		{"100mb", 100 << 20, nil},
+		{" 1 GB ", 1 << 30, nil},
+		{"1.5GB", 0, errInvalidSize},
+		{"-1MB", 0, errInvalidSize},
+		{"MB", 0, errInvalidSize},
+		{"10TB", 0, errInvalidSize},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.input)
+		if size != test.size || err != test.err {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, %v", test.input, size, err, test.size, test.err)
+		}
+	}
+}
+
+// readRotated returns the lines of the file at path and of the files it was
+// rotated to, oldest first, along with how many rotated files there are.
+func readRotated(t *testing.T, path string) (lines []string, rotated int) {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	for _, name := range append(matches, path) {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b []byte
+		if strings.HasSuffix(name, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = ioutil.ReadAll(gz)
+		} else {
+			b, err = ioutil.ReadAll(f)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 0 {
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+		}
+	}
+	return lines, len(matches)
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotation rotation
+		pause    time.Duration
+		rotated  int
+		kept     int
+	}{
+		{name: "never", rotation: rotation{}, rotated: 0, kept: 10},
+		{name: "by size", rotation: rotation{maxSize: 16}, rotated: 4, kept: 10},
+		{name: "by interval", rotation: rotation{interval: 30 * time.Millisecond}, pause: 30 * time.Millisecond, rotated: 9, kept: 10},
+		{name: "by size keeping 2", rotation: rotation{maxSize: 16, keep: 2}, rotated: 2, kept: 6},
+		{name: "by size compressed", rotation: rotation{maxSize: 16, compress: true}, rotated: 4, kept: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "aggregator-rotate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "out.log")
+
+			rf, err := openRotatingFile(path, test.rotation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for i := 0; i < 10; i++ {
+				line := fmt.Sprintf("line %d", i)
+				want = append(want, line)
+				if _, err := rf.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+				// Rotated files are named after the millisecond they
+				// were rotated in.
+				time.Sleep(2*time.Millisecond + test.pause)
+			}
+			if err := rf.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			lines, rotated := readRotated(t, path)
+			want = want[len(want)-test.kept:]
+			if strings.Join(lines, "|") != strings.Join(want, "|") {
+				t.Errorf("got lines %q, want %q", lines, want)
+			}
+			if rotated != test.rotated {
+				t.Errorf("got %d rotated files, want %d", rotated, test.rotated)
+			}
+		})
+	}
+}
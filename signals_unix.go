@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchControlSignals reopens our output files and reloads the config file on
+// SIGHUP, and logs the status of every source on SIGUSR1. The returned func
+// stops watching for them.
+func watchControlSignals(c controls) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				switch sig {
+				case syscall.SIGHUP:
+					c.hangup()
+				case syscall.SIGUSR1:
+					c.status()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
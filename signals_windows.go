@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+// watchControlSignals does nothing on windows, which has neither SIGHUP nor
+// SIGUSR1.
+func watchControlSignals(c controls) func() {
+	return func() {}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	sinkStdout = "stdout"
+	sinkStderr = "stderr"
+	sinkFile   = "file"
+
+	defaultSinkBuffer = 1024
+
+	// sinkReportEvery is how many dropped lines go by between the messages
+	// telling the user a lossy sink is falling behind.
+	sinkReportEvery = 1000
+
+	// spillChunkSize is how much of a spill file is read back at a time.
+	spillChunkSize = 64 * 1024
+)
+
+var (
+	errInvalidSink = errors.New("each entry under Sinks must have a Type of stdout, stderr or file, and a file sink must have a Path")
+	errNoSinks     = errors.New("Sinks must be a list of sinks")
+)
+
+// sinkConfig describes a single place aggregated events are written to, how
+// they are formatted, and which of them are written there.
+type sinkConfig struct {
+	eventFilter
+	kind       string
+	path       string
+	format     string
+	timePrefix string
+	buffer     int
+	lossy      bool
+	rotation   rotation
+}
+
+// parseSinkConfigs reads the Sinks list from the config file. Each entry has
+// a Type, and a Path when it is a file. Format, TimePrefix, the filter keys,
+// MinLevel, Sources, which are labels or paths (patterns are allowed) of the
+// locations that are written to the sink, Lossy and for files the rotation
+// keys are all optional. A sink that is the only one is never lossy, there
+// would be nowhere else the lines it drops end up.
+func parseSinkConfigs(raw interface{}) ([]sinkConfig, error) {
+	entries, ok := raw.([]interface{})
+	if !ok {
+		return nil, errNoSinks
+	}
+
+	var configs []sinkConfig
+	for _, e := range entries {
+		settings := lowerKeys(cast.ToStringMap(e))
+		c := sinkConfig{
+			kind:       cast.ToString(settings["type"]),
+			path:       cast.ToString(settings["path"]),
+			format:     formatText,
+			timePrefix: cast.ToString(settings["timeprefix"]),
+			buffer:     defaultSinkBuffer,
+		}
+		c.sources = toStrings(settings["sources"])
+		if c.kind != sinkStdout && c.kind != sinkStderr && c.kind != sinkFile || c.kind == sinkFile && c.path == "" {
+			return nil, errInvalidSink
+		}
+		if v, ok := settings["format"]; ok {
+			c.format = cast.ToString(v)
+		}
+		if err := validateOutputFormat(c.format); err != nil {
+			return nil, err
+		}
+		if v, ok := settings["buffer"]; ok {
+			c.buffer = cast.ToInt(v)
+		}
+		c.lossy = cast.ToBool(settings["lossy"])
+
+		filter, err := parseLineFilter(settings)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.empty() {
+			c.filters = []*lineFilter{filter}
+		}
+		if c.minLevel, err = parseMinLevel(cast.ToString(settings["minlevel"])); err != nil {
+			return nil, err
+		}
+		if c.rotation, err = parseRotation(settings); err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	if len(configs) == 1 {
+		configs[0].lossy = false
+	}
+	return configs, nil
+}
+
+// name is how the sink is referred to in our diagnostics.
+func (c sinkConfig) name() string {
+	if c.kind == sinkFile {
+		return c.path
+	}
+	return c.kind
+}
+
+// fileSinks returns the sinks that write to files, leaving out the ones that
+// would write over the tui.
+func fileSinks(configs []sinkConfig) []sinkConfig {
+	var files []sinkConfig
+	for _, c := range configs {
+		if c.kind == sinkFile {
+			files = append(files, c)
+		}
+	}
+	return files
+}
+
+// sink writes events to one of the sinkConfigs. Events are queued and written
+// by a goroutine of its own, so a sink that is briefly slow does not hold up
+// the others. When the queue is full and the sink is lossy its events are
+// dropped. Otherwise, when there are other sinks, they are spilled to a
+// temporary file the goroutine writes out once it has caught up, so a sink
+// that is stuck never holds up the rest. A sink on its own has nobody to hold
+// up, so it waits for room in the queue, slowing down the reading of the
+// sources instead.
+type sink struct {
+	sinkConfig
+	writer  *eventWriter
+	file    *rotatingFile
+	queue   chan pendingEvent
+	done    chan struct{}
+	dropped uint64
+	failing bool
+
+	// spills is set when the sink spills events to disk rather than wait
+	// for room in its queue. spillMu guards the rest of the spill fields.
+	spills   bool
+	spillMu  sync.Mutex
+	spill    *os.File
+	spilling bool
+	spillAt  int64
+	spillEnd int64
+	spilled  chan struct{}
+}
+
+// openSink opens the file the sink writes to, if it has one, and starts the
+// goroutine that writes to it. Files are rotated per the sink's rotation.
+func openSink(c sinkConfig) (*sink, error) {
+	s := &sink{
+		sinkConfig: c,
+		writer:     &eventWriter{out: os.Stdout, format: c.format, timePrefix: c.timePrefix},
+		queue:      make(chan pendingEvent, c.buffer),
+		done:       make(chan struct{}),
+		spilled:    make(chan struct{}, 1),
+	}
+
+	switch c.kind {
+	case sinkStdout:
+		s.writer.colorize = c.format == formatText && isTerminal(os.Stdout)
+	case sinkStderr:
+		s.writer.out = os.Stderr
+		s.writer.colorize = c.format == formatText && isTerminal(os.Stderr)
+	case sinkFile:
+		f, err := openRotatingFile(c.path, c.rotation)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+		s.writer.out = f
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// enqueue hands the event to the sink's goroutine. When the queue is full a
+// lossy sink drops the event, a sink that spills writes it to its spill file
+// and any other sink waits for room in the queue.
+func (s *sink) enqueue(src *source, e *event) {
+	p := pendingEvent{source: src, event: e}
+	switch {
+	case s.lossy:
+		select {
+		case s.queue <- p:
+		default:
+			s.drop()
+		}
+	case s.spills:
+		s.queueOrSpill(p)
+	default:
+		s.queue <- p
+	}
+}
+
+// drop counts an event the sink had no room for.
+func (s *sink) drop() {
+	if n := atomic.AddUint64(&s.dropped, 1); n == 1 || n%sinkReportEvery == 0 {
+		log.Println("Sink", s.name(), "is falling behind, lines dropped so far:", n)
+	}
+}
+
+// queueOrSpill queues the event, or appends it to the spill file when the
+// queue is full. Once the sink spills, every event is spilled until the
+// goroutine has written out the spill file, to keep them in order.
+func (s *sink) queueOrSpill(p pendingEvent) {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	if !s.spilling {
+		select {
+		case s.queue <- p:
+			return
+		default:
+		}
+	}
+
+	b, err := s.writer.formatEvent(p.source, p.event)
+	if err == nil {
+		err = s.appendSpill(b)
+	}
+	if err != nil {
+		log.Println("Unable to spill lines of sink", s.name(), err)
+		s.drop()
+		return
+	}
+	if !s.spilling {
+		log.Println("Sink", s.name(), "is falling behind, spilling lines to", s.spill.Name())
+		s.spilling = true
+	}
+	select {
+	case s.spilled <- struct{}{}:
+	default:
+	}
+}
+
+// appendSpill writes b to the end of the spill file, creating the file the
+// first time the sink spills.
+func (s *sink) appendSpill(b []byte) error {
+	if s.spill == nil {
+		f, err := ioutil.TempFile("", "aggregator-sink")
+		if err != nil {
+			return err
+		}
+		s.spill = f
+	}
+	n, err := s.spill.WriteAt(b, s.spillEnd)
+	s.spillEnd += int64(n)
+	return err
+}
+
+// run writes queued events until the queue is closed, and what was spilled
+// whenever the queue runs empty. A sink that fails to write is reported
+// once, and again once it recovers.
+func (s *sink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case p, ok := <-s.queue:
+			if !ok {
+				s.writeSpill()
+				return
+			}
+			s.report(s.writer.write(p.source, p.event))
+		case <-s.spilled:
+		}
+		if len(s.queue) == 0 {
+			s.writeSpill()
+		}
+	}
+}
+
+// writeSpill writes out the spill file until it has caught up with the
+// events still being spilled, then empties it so events are queued again.
+// Events are only spilled once the queue is full and no more are queued
+// while spilling, so everything queued has been written by the time the
+// queue runs empty.
+func (s *sink) writeSpill() {
+	buf := make([]byte, spillChunkSize)
+	for {
+		s.spillMu.Lock()
+		if s.spillAt == s.spillEnd {
+			if s.spilling {
+				s.spilling = false
+				s.spillAt, s.spillEnd = 0, 0
+				if err := s.spill.Truncate(0); err != nil {
+					log.Println("Unable to empty the spill file of sink", s.name(), err)
+				}
+				log.Println("Sink", s.name(), "caught up")
+			}
+			s.spillMu.Unlock()
+			return
+		}
+		n, err := s.spill.ReadAt(buf, s.spillAt)
+		s.spillMu.Unlock()
+		if n == 0 {
+			// The spill can't be read back, there is no getting those
+			// lines back either.
+			log.Println("Unable to read the spill file of sink", s.name(), err)
+			s.spillMu.Lock()
+			s.spillAt = s.spillEnd
+			s.spillMu.Unlock()
+			continue
+		}
+
+		// Write whole lines, so a file sink doesn't rotate halfway through
+		// one.
+		chunk := buf[:n]
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			chunk = chunk[:i+1]
+		}
+		s.report(s.writer.writeRaw(chunk))
+		s.spillMu.Lock()
+		s.spillAt += int64(len(chunk))
+		s.spillMu.Unlock()
+	}
+}
+
+// report logs the sink failing to write, once, and again once it recovers.
+func (s *sink) report(err error) {
+	switch {
+	case err != nil && !s.failing:
+		log.Println("Unable to write to sink", s.name(), err)
+		s.failing = true
+	case err == nil && s.failing:
+		log.Println("Sink", s.name(), "recovered")
+		s.failing = false
+	}
+}
+
+// status describes how many lines the sink has dropped and how much it has
+// spilled that is still waiting to be written.
+func (s *sink) status() string {
+	s.spillMu.Lock()
+	spilled := s.spillEnd - s.spillAt
+	s.spillMu.Unlock()
+	return fmt.Sprintf("Sink %s: %d lines dropped, %d bytes spilled to disk waiting to be written",
+		s.name(), atomic.LoadUint64(&s.dropped), spilled)
+}
+
+// reopen reopens the sink's file, if it has one.
+func (s *sink) reopen() {
+	if s.file == nil {
+		return
+	}
+	if err := s.file.reopen(); err != nil {
+		log.Println("Unable to reopen sink", s.name(), err)
+		return
+	}
+	log.Println("Reopened sink", s.name())
+}
+
+// close waits for the queued and spilled events to be written and closes the
+// sink's file, removing its spill file.
+func (s *sink) close() {
+	close(s.queue)
+	<-s.done
+	if s.file != nil {
+		s.file.Close()
+	}
+	if s.spill != nil {
+		s.spill.Close()
+		os.Remove(s.spill.Name())
+	}
+}
+
+// sinkSet hands every event to each of the sinks that want it.
+type sinkSet struct {
+	sinks []*sink
+}
+
+// openSinks opens each of the sinks, closing the ones already opened if one
+// of them fails. When there is more than one, the sinks that aren't lossy
+// spill to disk rather than hold up the others.
+func openSinks(configs []sinkConfig) (*sinkSet, error) {
+	ss := &sinkSet{}
+	for _, c := range configs {
+		s, err := openSink(c)
+		if err != nil {
+			ss.close()
+			return nil, fmt.Errorf("unable to open sink %s: %s", c.name(), err)
+		}
+		s.spills = !c.lossy && len(configs) > 1
+		ss.sinks = append(ss.sinks, s)
+	}
+	return ss, nil
+}
+
+// write implements eventOutput.
+func (ss *sinkSet) write(src *source, e *event) {
+	for _, s := range ss.sinks {
+		if s.wants(src, e) {
+			s.enqueue(src, e)
+		}
+	}
+}
+
+// status logs how each of the sinks that can fall behind is keeping up.
+func (ss *sinkSet) status() {
+	for _, s := range ss.sinks {
+		if s.lossy || s.spills {
+			log.Println(s.status())
+		}
+	}
+}
+
+// reopen reopens the files of every sink.
+func (ss *sinkSet) reopen() {
+	for _, s := range ss.sinks {
+		s.reopen()
+	}
+}
+
+// close closes every sink, writing out what they still had queued.
+func (ss *sinkSet) close() {
+	var wg sync.WaitGroup
+	for _, s := range ss.sinks {
+		wg.Add(1)
+		go func(s *sink) {
+			defer wg.Done()
+			s.close()
+		}(s)
+	}
+	wg.Wait()
+}
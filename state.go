@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateSaveInterval is how often the offsets are saved while running, on top
+// of saving them when shutting down.
+const stateSaveInterval = 5 * time.Second
+
+// savedSource is what we remember about a file between runs, how far into it
+// we got and which file it was.
+type savedSource struct {
+	Offset int64  `json:"offset"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+}
+
+// stateFile keeps the offset of every source in a json file, so a restart
+// picks up where the last run left off.
+type stateFile struct {
+	mu      sync.Mutex
+	path    string
+	sources map[string]savedSource
+	done    chan struct{}
+}
+
+// loadStateFile reads the state file at path, a file that is not there yet is
+// treated as an empty one.
+func loadStateFile(path string) (*stateFile, error) {
+	sf := &stateFile{path: path, sources: make(map[string]savedSource), done: make(chan struct{})}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &sf.sources); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// resumeOffset returns the offset to start reading the file at path from. ok
+// is false when there is nothing saved for the file, or when the file was
+// rotated (it is a different file now) or truncated (it is smaller than the
+// offset) since, in which case it should be read from the beginning.
+func (sf *stateFile) resumeOffset(path string) (offset int64, ok bool, rotated bool) {
+	if sf == nil {
+		return 0, false, false
+	}
+	sf.mu.Lock()
+	saved, found := sf.sources[path]
+	sf.mu.Unlock()
+	if !found {
+		return 0, false, false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, false, false
+	}
+	device, inode, known := fileIdentity(fi)
+	if known && (device != saved.Device || inode != saved.Inode) || fi.Size() < saved.Offset {
+		return 0, false, true
+	}
+	return saved.Offset, true, false
+}
+
+// update records where each of the sources is at, along with the file it is
+// reading. That is the file the source opened, which is no longer the one at
+// its path once it was rotated.
+func (sf *stateFile) update(sources []*source) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	for _, s := range sources {
+		// The identity is loaded first, should the source move on to
+		// another file in between the offset goes with the file after it,
+		// which only makes the next run read that file from its beginning.
+		id, _ := s.identity.Load().(fileID)
+		offset := s.consumed()
+		if offset < 0 || !s.isFile() {
+			continue
+		}
+		sf.sources[s.path] = savedSource{Offset: offset, Device: id.device, Inode: id.inode}
+	}
+}
+
+// record updates where the sources are at and saves the state, it does
+// nothing when there is no state file.
+func (sf *stateFile) record(sources []*source) {
+	if sf == nil {
+		return
+	}
+	sf.update(sources)
+	if err := sf.save(); err != nil {
+		log.Println("Unable to save the state file:", err)
+	}
+}
+
+// forget drops what we know about the file at path, it is no longer tailed.
+func (sf *stateFile) forget(path string) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	delete(sf.sources, path)
+}
+
+// save writes the state to disk. It is written to a temporary file first, so
+// the state file is never left half written.
+func (sf *stateFile) save() error {
+	sf.mu.Lock()
+	b, err := json.MarshalIndent(sf.sources, "", "  ")
+	sf.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(sf.path), filepath.Base(sf.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), sf.path)
+}
+
+// run saves the offsets of the tails every stateSaveInterval until close is
+// called.
+func (sf *stateFile) run(tails *tailSet) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sf.update(tails.list())
+			if err := sf.save(); err != nil {
+				log.Println("Unable to save the state file:", err)
+			}
+		case <-sf.done:
+			return
+		}
+	}
+}
+
+// close stops saving the offsets periodically.
+func (sf *stateFile) close() {
+	close(sf.done)
+}
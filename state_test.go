@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregator-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("one\ntwo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, known := identify(fi)
+
+	tests := []struct {
+		name     string
+		saved    *savedSource
+		offset   int64
+		ok       bool
+		rotated  bool
+		identity bool
+	}{
+		{name: "nothing saved"},
+		{name: "same file", saved: &savedSource{Offset: 4, Device: id.device, Inode: id.inode}, offset: 4, ok: true},
+		{name: "read to the end", saved: &savedSource{Offset: 8, Device: id.device, Inode: id.inode}, offset: 8, ok: true},
+		{name: "truncated", saved: &savedSource{Offset: 20, Device: id.device, Inode: id.inode}, rotated: true},
+		{name: "another file", saved: &savedSource{Offset: 4, Device: id.device, Inode: id.inode + 1}, rotated: true, identity: true},
+	}
+
+	for _, test := range tests {
+		if test.identity && !known {
+			// Without device and inode, files are only told apart by
+			// their size.
+			continue
+		}
+		sf := &stateFile{sources: make(map[string]savedSource)}
+		if test.saved != nil {
+			sf.sources[path] = *test.saved
+		}
+		offset, ok, rotated := sf.resumeOffset(path)
+		if offset != test.offset || ok != test.ok || rotated != test.rotated {
+			t.Errorf("%s: got %d, %v, %v, want %d, %v, %v", test.name, offset, ok, rotated, test.offset, test.ok, test.rotated)
+		}
+	}
+}
+
+// readTexts returns the texts of the events that come in within wait.
+func readTexts(out eventChan, wait time.Duration) []string {
+	var texts []string
+	for {
+		select {
+		case e := <-out:
+			texts = append(texts, e.Text)
+		case <-time.After(wait):
+			return texts
+		}
+	}
+}
+
+func TestStateResumesAcrossRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregator-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	statePath := filepath.Join(dir, "state")
+	if err := ioutil.WriteFile(path, []byte("one\ntwo\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// run tails the file until it has read want lines, or stops once no
+	// more came in for a while when want is 0, returning what it read.
+	run := func(want int, rotate func()) []string {
+		state, err := loadStateFile(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(eventChan, 10)
+		ts := newTailSet(out, state, false)
+		if err := ts.add(newLocation(path, location{options: defaultTailOptions()})); err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for i := 0; i < want; i++ {
+			texts = append(texts, out.next(t).Text)
+		}
+		if rotate != nil {
+			rotate()
+		}
+		texts = append(texts, readTexts(out, 300*time.Millisecond)...)
+		ts.stopAll()
+		for len(out) > 0 {
+			texts = append(texts, (<-out).Text)
+		}
+		return texts
+	}
+
+	first := run(2, func() {
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("three\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	})
+	second := run(0, nil)
+
+	// Whether or not the first run got to the new file before it stopped,
+	// between them the runs read every line once.
+	got := append(first, second...)
+	want := []string{"one", "two", "three"}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
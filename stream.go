@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+)
+
+// stdinPath is the location that stands for our stdin.
+const stdinPath = "-"
+
+// isStream reports whether the location is a stream, a command, a listener,
+// docker containers, the journal or stdin, rather than a file or pattern.
+func (l location) isStream() bool {
+	return l.command != nil || l.listener != nil || l.docker != nil || l.journal != nil || l.path == stdinPath
+}
+
+// startStream starts reading the stream of the location, adding a source to
+// the set for each of its streams. Callers hold the lock.
+func (ts *tailSet) startStream(l location) error {
+	switch {
+	case l.command != nil:
+		return ts.startCommand(l)
+	case l.listener != nil:
+		return ts.startListener(l)
+	case l.docker != nil:
+		return ts.startDocker(l)
+	case l.journal != nil:
+		return ts.startJournal(l)
+	}
+	lines := make(chan *tail.Line)
+	quit := make(chan struct{})
+	var once sync.Once
+	go forwardStdin(lines, quit)
+	ts.startSource(&source{location: l, lines: lines, stop: func() { once.Do(func() { close(quit) }) }})
+	return nil
+}
+
+var (
+	stdinOnce  sync.Once
+	stdinLines = make(chan *tail.Line)
+)
+
+// forwardStdin sends the lines read from stdin to lines until stdin runs out
+// or quit is closed. Stdin is only read once, by whichever source is reading
+// it at the time, so a source that replaces another picks up where it left
+// off.
+func forwardStdin(lines chan<- *tail.Line, quit <-chan struct{}) {
+	defer close(lines)
+	stdinOnce.Do(func() {
+		go readLines(os.Stdin, stdinLines, func() { close(stdinLines) })
+	})
+	for {
+		select {
+		case line, ok := <-stdinLines:
+			if !ok {
+				return
+			}
+			select {
+			case lines <- line:
+			case <-quit:
+				return
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// startSource adds the source to the set and starts handing its events to
+// the set's output, closing the source's done once it runs out of them.
+// Callers hold the lock.
+func (ts *tailSet) startSource(s *source) {
+	ts.sources[s.path] = s
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		tailFile(s, ts.out)
+		s.finish()
+	}()
+}
+
+// addChild adds a source that a stream, such as a listener, opened while
+// running, unless the set or the stream, whose quit is closed once it stops,
+// was stopped in the meantime.
+func (ts *tailSet) addChild(quit <-chan struct{}, s *source) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	select {
+	case <-quit:
+		return false
+	default:
+	}
+	if ts.closed {
+		return false
+	}
+	ts.startSource(s)
+	return true
+}
+
+// dropChild removes a source added by addChild once it is done.
+func (ts *tailSet) dropChild(s *source) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.sources[s.path] == s {
+		delete(ts.sources, s.path)
+	}
+}
+
+// readLines reads r line by line, sending each line to lines, and calls done
+// once r runs out. Lines can be of any length, a line ending in \r\n has both
+// removed.
+func readLines(r io.Reader, lines chan<- *tail.Line, done func()) {
+	defer done()
+	br := bufio.NewReader(r)
+	for {
+		text, err := br.ReadString('\n')
+		if text != "" {
+			lines <- &tail.Line{Text: strings.TrimRight(text, "\r\n"), Time: time.Now()}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
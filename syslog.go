@@ -0,0 +1,217 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// formatSyslog is the Format of a listener that receives syslog messages.
+const formatSyslog = "syslog"
+
+var (
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	// syslogLevels maps each severity to the level we give it.
+	syslogLevels = []level{levelFatal, levelFatal, levelFatal, levelError, levelWarn, levelInfo, levelInfo, levelDebug}
+)
+
+// isSyslog reports whether the location receives syslog messages.
+func (l location) isSyslog() bool {
+	return l.listener != nil && l.listener.format == formatSyslog
+}
+
+// syslogMessage is a message in either of the syslog formats, RFC 5424 or the
+// older RFC 3164. Fields the sender left out are empty.
+type syslogMessage struct {
+	facility       int
+	severity       int
+	timestamp      time.Time
+	hostname       string
+	appName        string
+	procID         string
+	msgID          string
+	structuredData string
+	message        string
+}
+
+// parseSyslog parses the text as a syslog message, ok is false when it does
+// not start with a priority. Messages in the RFC 3164 format are parsed as
+// far as they follow it, the rest of them ends up in the message. Their
+// timestamps have no year, see stampYear.
+func parseSyslog(text string, now time.Time) (m syslogMessage, ok bool) {
+	end := strings.IndexByte(text, '>')
+	if !strings.HasPrefix(text, "<") || end < 2 || end > 4 {
+		return m, false
+	}
+	pri, err := strconv.Atoi(text[1:end])
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return m, false
+	}
+	m.facility, m.severity = pri/8, pri%8
+
+	rest := text[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return m, m.parse5424(rest[2:])
+	}
+	m.parse3164(rest, now)
+	return m, true
+}
+
+// parse5424 parses what follows the version of an RFC 5424 message.
+func (m *syslogMessage) parse5424(rest string) bool {
+	fields := strings.SplitN(rest, " ", 6)
+	if len(fields) < 6 {
+		return false
+	}
+	if fields[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return false
+		}
+		m.timestamp = t
+	}
+	m.hostname = syslogValue(fields[1])
+	m.appName = syslogValue(fields[2])
+	m.procID = syslogValue(fields[3])
+	m.msgID = syslogValue(fields[4])
+
+	sd, msg, ok := splitStructuredData(fields[5])
+	if !ok {
+		return false
+	}
+	m.structuredData = sd
+	m.message = strings.TrimPrefix(msg, "\ufeff")
+	return true
+}
+
+// syslogValue returns the value of an RFC 5424 header field, - means the
+// sender left it out.
+func syslogValue(v string) string {
+	if v == "-" {
+		return ""
+	}
+	return v
+}
+
+// splitStructuredData splits the structured data of an RFC 5424 message from
+// the message that follows it. Quoted values may hold escaped quotes and
+// brackets.
+func splitStructuredData(s string) (sd, msg string, ok bool) {
+	if strings.HasPrefix(s, "-") {
+		return "", strings.TrimPrefix(s[1:], " "), true
+	}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		quoted := false
+		for i++; i < len(s) && (quoted || s[i] != ']'); i++ {
+			switch {
+			case s[i] == '\\' && quoted:
+				i++
+			case s[i] == '"':
+				quoted = !quoted
+			}
+		}
+		if i >= len(s) {
+			return "", "", false
+		}
+		i++
+	}
+	if i == 0 {
+		return "", "", false
+	}
+	return s[:i], strings.TrimPrefix(s[i:], " "), true
+}
+
+// parse3164 parses what follows the priority of an RFC 3164 message, that is
+// a timestamp, a hostname and a tag holding the name of the app and its pid.
+// Senders on the same machine often leave the hostname out.
+func (m *syslogMessage) parse3164(rest string, now time.Time) {
+	if len(rest) >= len(time.Stamp) {
+		if t, err := time.ParseInLocation(time.Stamp, rest[:len(time.Stamp)], now.Location()); err == nil {
+			m.timestamp = stampYear(t, now)
+			rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+			if i := strings.IndexByte(rest, ' '); i > 0 && !strings.ContainsAny(rest[:i], ":[") {
+				m.hostname, rest = rest[:i], rest[i+1:]
+			}
+		}
+	}
+	m.appName, m.procID, m.message = splitSyslogTag(rest)
+}
+
+// stampYear puts the timestamp, which has no year, in the year it most likely
+// is from, the current one unless that would put it in the future.
+func stampYear(t, now time.Time) time.Time {
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// splitSyslogTag splits the tag in front of an RFC 3164 message, such as
+// app[123]: or app:, from the message. The whole text is the message when it
+// has no tag.
+func splitSyslogTag(s string) (app, pid, msg string) {
+	i := strings.IndexAny(s, "[: ")
+	if i <= 0 || s[i] == ' ' {
+		return "", "", s
+	}
+	app, rest := s[:i], s[i:]
+	if rest[0] == '[' {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return "", "", s
+		}
+		pid, rest = rest[1:end], rest[end+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", "", s
+	}
+	return app, pid, strings.TrimPrefix(rest[1:], " ")
+}
+
+// text returns the message the way syslog daemons write it to a file, behind
+// the name of the app and its pid.
+func (m syslogMessage) text() string {
+	switch {
+	case m.appName == "":
+		return m.message
+	case m.procID == "":
+		return m.appName + ": " + m.message
+	}
+	return m.appName + "[" + m.procID + "]: " + m.message
+}
+
+// level returns the level the message's severity maps to.
+func (m syslogMessage) level() level {
+	return syslogLevels[m.severity]
+}
+
+// fields returns the header of the message as the fields of its event, added
+// to the ones already there.
+func (m syslogMessage) fields(fields map[string]interface{}) map[string]interface{} {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["facility"] = syslogFacilities[m.facility]
+	fields["severity"] = syslogSeverities[m.severity]
+	optional := map[string]string{
+		"hostname":       m.hostname,
+		"appname":        m.appName,
+		"procid":         m.procID,
+		"msgid":          m.msgID,
+		"structureddata": m.structuredData,
+	}
+	for k, v := range optional {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		text      string
+		now       time.Time
+		ok        bool
+		want      syslogMessage
+		timestamp time.Time
+	}{
+		{
+			name: "rfc5424",
+			text: "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed for lonvick on /dev/pts/8",
+			ok:   true,
+			want: syslogMessage{
+				facility: 4,
+				severity: 2,
+				hostname: "mymachine.example.com",
+				appName:  "su",
+				msgID:    "ID47",
+				message:  "'su root' failed for lonvick on /dev/pts/8",
+			},
+			timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		},
+		{
+			name: "rfc5424 nil values",
+			text: "<165>1 - - - - - -",
+			ok:   true,
+			want: syslogMessage{facility: 20, severity: 5},
+		},
+		{
+			name: "rfc5424 structured data with an escaped bracket",
+			text: `<165>1 2003-10-11T22:14:15.003Z host app 1234 ID1 [ex@32473 iut="3" eventSource="App\]lication"][other@1 a="b"] An application event`,
+			ok:   true,
+			want: syslogMessage{
+				facility:       20,
+				severity:       5,
+				hostname:       "host",
+				appName:        "app",
+				procID:         "1234",
+				msgID:          "ID1",
+				structuredData: `[ex@32473 iut="3" eventSource="App\]lication"][other@1 a="b"]`,
+				message:        "An application event",
+			},
+			timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		},
+		{
+			name: "rfc5424 unterminated structured data",
+			text: `<165>1 - host app - - [ex a="b" no end`,
+		},
+		{
+			name: "rfc5424 bad timestamp",
+			text: "<165>1 yesterday host app - - - hello",
+		},
+		{
+			name: "rfc5424 too few fields",
+			text: "<165>1 - host app",
+		},
+		{
+			name: "rfc3164",
+			text: "<13>Feb  5 17:32:18 myhost sshd[4242]: Accepted publickey",
+			ok:   true,
+			want: syslogMessage{
+				facility: 1,
+				severity: 5,
+				hostname: "myhost",
+				appName:  "sshd",
+				procID:   "4242",
+				message:  "Accepted publickey",
+			},
+			timestamp: time.Date(2026, 2, 5, 17, 32, 18, 0, time.UTC),
+		},
+		{
+			name: "rfc3164 without a hostname",
+			text: "<13>Feb  5 17:32:18 sshd: hello",
+			ok:   true,
+			want: syslogMessage{
+				facility: 1,
+				severity: 5,
+				appName:  "sshd",
+				message:  "hello",
+			},
+			timestamp: time.Date(2026, 2, 5, 17, 32, 18, 0, time.UTC),
+		},
+		{
+			name: "rfc3164 from last year",
+			text: "<13>Dec 31 23:59:00 host cron: tick",
+			now:  time.Date(2026, 1, 1, 0, 30, 0, 0, time.UTC),
+			ok:   true,
+			want: syslogMessage{
+				facility: 1,
+				severity: 5,
+				hostname: "host",
+				appName:  "cron",
+				message:  "tick",
+			},
+			timestamp: time.Date(2025, 12, 31, 23, 59, 0, 0, time.UTC),
+		},
+		{
+			name: "rfc3164 without a timestamp or tag",
+			text: "<14>just some text",
+			ok:   true,
+			want: syslogMessage{facility: 1, severity: 6, message: "just some text"},
+		},
+		{
+			name: "missing priority",
+			text: "Feb  5 17:32:18 myhost sshd[4242]: Accepted publickey",
+		},
+		{
+			name: "empty priority",
+			text: "<>1 - - - - - -",
+		},
+		{
+			name: "priority out of range",
+			text: "<192>1 - - - - - -",
+		},
+		{
+			name: "priority not a number",
+			text: "<ab>hello",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			at := test.now
+			if at.IsZero() {
+				at = now
+			}
+			m, ok := parseSyslog(test.text, at)
+			if ok != test.ok {
+				t.Fatalf("got ok %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if !m.timestamp.Equal(test.timestamp) {
+				t.Errorf("got timestamp %v, want %v", m.timestamp, test.timestamp)
+			}
+			m.timestamp = time.Time{}
+			if m != test.want {
+				t.Errorf("got %+v, want %+v", m, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitStructuredData(t *testing.T) {
+	tests := []struct {
+		input string
+		sd    string
+		msg   string
+		ok    bool
+	}{
+		{input: "-", ok: true},
+		{input: "- hello", msg: "hello", ok: true},
+		{input: `[a@1 x="y"]`, sd: `[a@1 x="y"]`, ok: true},
+		{input: `[a@1 x="y"] hello`, sd: `[a@1 x="y"]`, msg: "hello", ok: true},
+		{input: `[a@1 x="]"] hello`, sd: `[a@1 x="]"]`, msg: "hello", ok: true},
+		{input: `[a@1 x="\]"][b@1] hello`, sd: `[a@1 x="\]"][b@1]`, msg: "hello", ok: true},
+		{input: `[a@1 x="\"]"] hello`, sd: `[a@1 x="\"]"]`, msg: "hello", ok: true},
+		{input: `[a@1 x="y" hello`},
+		{input: "hello"},
+	}
+
+	for _, test := range tests {
+		sd, msg, ok := splitStructuredData(test.input)
+		if sd != test.sd || msg != test.msg || ok != test.ok {
+			t.Errorf("splitStructuredData(%q) = %q, %q, %v, want %q, %q, %v", test.input, sd, msg, ok, test.sd, test.msg, test.ok)
+		}
+	}
+}
+
+func TestReadSyslogFraming(t *testing.T) {
+	octets := func(msg string) string { return fmt.Sprintf("%d %s", len(msg), msg) }
+	ln := &listener{location: location{listener: &listenerSpec{format: formatSyslog, maxLineSize: 64}}}
+
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{
+			name:  "newline",
+			input: "<13>first\n<13>second\r\n<13>last without a newline",
+			want:  []string{"<13>first", "<13>second", "<13>last without a newline"},
+			err:   io.EOF,
+		},
+		{
+			name:  "octet counted",
+			input: octets("<13>1 - - - - - - first") + octets("<13>1 - - - - - - two\nlines"),
+			want:  []string{"<13>1 - - - - - - first", "<13>1 - - - - - - two\nlines"},
+			err:   io.EOF,
+		},
+		{
+			name:  "octet counted and newline mixed",
+			input: octets("<13>framed\n") + "<13>plain\n" + octets("<13>framed again"),
+			want:  []string{"<13>framed", "<13>plain", "<13>framed again"},
+			err:   io.EOF,
+		},
+		{
+			name:  "octet counted too long",
+			input: "65 " + strings.Repeat("x", 65),
+			err:   errFrameTooLong,
+		},
+		{
+			name:  "octet count not a number",
+			input: "12a <13>hello",
+			err:   errInvalidOctets,
+		},
+		{
+			name:  "octet count with too many digits",
+			input: "00000000012 <13>hello",
+			err:   errInvalidOctets,
+		},
+		{
+			name:  "octet count without a space",
+			input: "5\n<13>hello",
+			err:   errInvalidOctets,
+		},
+		{
+			name:  "octet counted cut short",
+			input: "20 <13>short",
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "newline too long",
+			input: "<13>" + strings.Repeat("x", 100) + "\n<13>next\n",
+			want:  []string{"<13>" + strings.Repeat("x", 60), "<13>next"},
+			err:   io.EOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(strings.NewReader(test.input), 16)
+			var got []string
+			var err error
+			for {
+				var text string
+				text, err = ln.readMessage(br)
+				if text != "" {
+					got = append(got, text)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if err != test.err {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hpcloud/tail"
+)
+
+const (
+	// replacedIdle is how long the file a source was reading has to go
+	// without being appended to, once it was replaced by another file, before
+	// we stop reading it. replacedPoll is how often it is checked meanwhile.
+	replacedIdle = time.Second
+	replacedPoll = 100 * time.Millisecond
+)
+
+// tailSet keeps track of every file we are currently tailing, keyed by its
+// path. Files matched by a pattern come and go while we are running, so the
+// set is shared between the startup code and the pattern watcher. Files that
+// could not be tailed are kept in pending while they are retried, when
+// retryUnavailable is set.
+type tailSet struct {
+	mu               sync.Mutex
+	sources          map[string]*source
+	pending          map[string]*pendingSource
+	out              eventOutput
+	state            *stateFile
+	retryUnavailable bool
+	closed           bool
+
+	// draining counts the sources that are no longer in the set but are
+	// still reading the rest of a file that was replaced, quit is closed to
+	// have them stop waiting for more.
+	draining sync.WaitGroup
+	quit     chan struct{}
+}
+
+// newTailSet returns an empty tailSet, the events of every source added to it
+// are written to out. When state is not nil, files it holds an offset for are
+// resumed from that offset. When retryUnavailable is set, files that can not
+// be tailed are retried in the background.
+func newTailSet(out eventOutput, state *stateFile, retryUnavailable bool) *tailSet {
+	return &tailSet{
+		sources:          make(map[string]*source),
+		pending:          make(map[string]*pendingSource),
+		out:              out,
+		state:            state,
+		retryUnavailable: retryUnavailable,
+		quit:             make(chan struct{}),
+	}
+}
+
+// add starts tailing the location, unless its file is already being tailed.
+func (ts *tailSet) add(l location) error {
+	return ts.start(l, -1)
+}
+
+// replace restarts the tail of the location's file with the location's
+// settings, picking up where the tail it replaces left off. A command is
+// stopped and started again.
+func (ts *tailSet) replace(l location) error {
+	ts.mu.Lock()
+	s, ok := ts.sources[l.path]
+	if ok {
+		stopSource(s)
+		delete(ts.sources, l.path)
+	}
+	for p, s := range ts.sources {
+		if isWithin(l.path, p) {
+			stopSource(s)
+			delete(ts.sources, p)
+		}
+	}
+	ts.mu.Unlock()
+
+	if !ok || l.isStream() {
+		return ts.start(l, -1)
+	}
+	return ts.start(l, s.consumed())
+}
+
+// start starts tailing the location at the offset from, or where the location
+// asks to start when from is below 0. Commands and stdin are read from
+// wherever they are at.
+func (ts *tailSet) start(l location, from int64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.has(l.path) || ts.closed {
+		return nil
+	}
+	if l.isStream() {
+		return ts.startStream(l)
+	}
+
+	config := l.options.tailConfig(l.path)
+	offset, resume, rotated := ts.state.resumeOffset(l.path)
+	switch {
+	case from >= 0:
+		config.Location = &tail.SeekInfo{Offset: from, Whence: io.SeekStart}
+	case resume:
+		config.Location = &tail.SeekInfo{Offset: offset, Whence: io.SeekStart}
+	case rotated:
+		log.Println("Log file was rotated or truncated since the last run, reading it from the beginning:", l.path)
+		config.Location = nil
+	}
+
+	t, err := tail.TailFile(l.path, config)
+	if err != nil {
+		return err
+	}
+	s := &source{location: l, tail: t, lines: t.Lines, stop: stopTail(t), offset: -1}
+	s.identify()
+	if config.Location == nil {
+		s.offset = 0
+	} else if config.Location.Whence == io.SeekStart {
+		s.offset = config.Location.Offset
+	}
+	ts.startSource(s)
+	return nil
+}
+
+// has reports whether path, or a stream beneath it, is in the set. Callers
+// hold the lock.
+func (ts *tailSet) has(path string) bool {
+	if _, ok := ts.sources[path]; ok {
+		return true
+	}
+	if !strings.HasPrefix(path, commandPrefix) {
+		return false
+	}
+	for p := range ts.sources {
+		if isWithin(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// tailing reports whether the file at path is in the set.
+func (ts *tailSet) tailing(path string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	_, ok := ts.sources[path]
+	return ok
+}
+
+// renamed looks for the source reading the file that showed up at path under
+// another name, reporting whether there was one. That source is replaced by
+// one reading the file at path from where it got to, under the same label.
+func (ts *tailSet) renamed(path string, fi os.FileInfo) bool {
+	id, ok := identify(fi)
+	if !ok {
+		return false
+	}
+	ts.mu.Lock()
+	var s *source
+	for _, c := range ts.sources {
+		if c.isFile() && c.path != path && c.identity.Load() == id {
+			s = c
+			break
+		}
+	}
+	if s == nil || ts.closed {
+		ts.mu.Unlock()
+		return false
+	}
+	stopSource(s)
+	delete(ts.sources, s.path)
+	if ts.state != nil {
+		ts.state.forget(s.path)
+	}
+	ts.mu.Unlock()
+
+	// Wait for the lines the source did read, so it is known where it got to.
+	<-s.done
+	log.Println("Log file was renamed, reading the rest of it at:", s.path, "->", path)
+	l := s.location
+	l.path = path
+	if err := ts.start(l, s.consumed()); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// recreated reports whether the file at path is already in the set. When the
+// file there now is not the one its source was reading, because that one was
+// renamed or removed, the source reads the rest of the old file and is then
+// replaced by one reading the new file from its beginning.
+func (ts *tailSet) recreated(path string, fi os.FileInfo) bool {
+	ts.mu.Lock()
+	s, ok := ts.sources[path]
+	if !ok {
+		ts.mu.Unlock()
+		return false
+	}
+	id, known := identify(fi)
+	if !s.isFile() || !known || s.identity.Load() == id || ts.closed {
+		ts.mu.Unlock()
+		return true
+	}
+	delete(ts.sources, path)
+	ts.draining.Add(1)
+	ts.mu.Unlock()
+
+	// Reading the rest of the old file is not waited for here, so the
+	// watcher carries on meanwhile.
+	atomic.StoreInt32(&s.replaced, 1)
+	go func() {
+		defer ts.draining.Done()
+		stopSource(s)
+		<-s.done
+		ts.drain(s)
+		log.Println("Started aggregating new log file:", path)
+		if err := ts.start(s.location, 0); err != nil {
+			log.Println(err)
+		}
+	}()
+	return true
+}
+
+// drain reads the rest of the file a source that was replaced was reading,
+// once it has stopped, as a writer that has yet to notice the file was moved
+// can still be appending to it. It is read until nothing was appended to it
+// for replacedIdle, or until the set is stopped.
+func (ts *tailSet) drain(s *source) {
+	f := s.file
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	offset := s.consumed()
+	if offset < 0 {
+		return
+	}
+
+	lines := make(chan *tail.Line)
+	go func() {
+		defer close(lines)
+		send := func(texts []string) {
+			for _, text := range texts {
+				lines <- &tail.Line{Text: text, Time: time.Now()}
+			}
+		}
+		appended := time.Now()
+		for time.Since(appended) < replacedIdle {
+			texts, end := readRest(f, offset, false)
+			send(texts)
+			if end > offset {
+				offset = end
+				appended = time.Now()
+			}
+			select {
+			case <-time.After(replacedPoll):
+			case <-ts.quit:
+				appended = time.Time{}
+			}
+		}
+		texts, _ := readRest(f, offset, true)
+		send(texts)
+	}()
+	tailFile(&source{location: s.location, lines: lines, offset: offset}, ts.out)
+}
+
+// list returns every source currently in the set.
+func (ts *tailSet) list() []*source {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	sources := make([]*source, 0, len(ts.sources))
+	for _, s := range ts.sources {
+		sources = append(sources, s)
+	}
+	return sources
+}
+
+// remove stops tailing the file at path, along with any files beneath it in
+// the event path was a directory.
+func (ts *tailSet) remove(path string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.forgetPending(path)
+	for p, s := range ts.sources {
+		if p == path || isWithin(path, p) {
+			log.Println("Stopped aggregating log file:", p)
+			stopSource(s)
+			delete(ts.sources, p)
+			if ts.state != nil {
+				ts.state.forget(p)
+			}
+		}
+	}
+}
+
+// stopAll stops every tail in the set, empties it and returns the sources
+// that were stopped, once the events of the lines they read were all handed
+// on, and the sources reading the rest of a replaced file are done. Only then
+// are the offsets the tails stopped at saved to the state file, if there is
+// one. Sources are waited on without the lock, as the streams among them take
+// it to drop the sources they added.
+func (ts *tailSet) stopAll() []*source {
+	ts.mu.Lock()
+	if !ts.closed {
+		ts.closed = true
+		close(ts.quit)
+	}
+	for p := range ts.pending {
+		ts.forgetPending(p)
+	}
+	var stopped []*source
+	for p, s := range ts.sources {
+		stopSource(s)
+		stopped = append(stopped, s)
+		delete(ts.sources, p)
+	}
+	ts.mu.Unlock()
+
+	for _, s := range stopped {
+		<-s.done
+	}
+	ts.draining.Wait()
+	ts.state.record(stopped)
+	return stopped
+}
+
+// stopSource stops reading the source's lines.
+func stopSource(s *source) {
+	s.stop()
+}
+
+// stopTail returns a func that stops the tail and removes the inotify watches
+// it created.
+func stopTail(t *tail.Tail) func() {
+	return func() {
+		t.Stop()
+		t.Cleanup()
+	}
+}
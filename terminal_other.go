@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errTerminalUnsupported = errors.New("the tui is not supported on this platform")
+
+// terminal is not supported on this platform, see terminal_unix.go.
+type terminal struct{}
+
+func makeRaw(f *os.File) (*terminal, error) {
+	return nil, errTerminalUnsupported
+}
+
+func (t *terminal) restore() error {
+	return nil
+}
+
+func (t *terminal) size() (int, int, error) {
+	return 0, 0, errTerminalUnsupported
+}
@@ -0,0 +1,65 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// terminal is a terminal we switched into raw mode, keeping the settings it
+// had before so they can be restored.
+type terminal struct {
+	fd    uintptr
+	saved unix.Termios
+}
+
+// winsize is the window size as the TIOCGWINSZ ioctl reports it.
+type winsize struct {
+	rows, cols, xpixel, ypixel uint16
+}
+
+// makeRaw switches the terminal f is attached to into raw mode, so we are
+// handed every key as it is pressed, without it being echoed.
+func makeRaw(f *os.File) (*terminal, error) {
+	t := &terminal{fd: f.Fd()}
+	if err := ioctl(t.fd, ioctlGetTermios, unsafe.Pointer(&t.saved)); err != nil {
+		return nil, err
+	}
+	raw := t.saved
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := ioctl(t.fd, ioctlSetTermios, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// restore puts the terminal back the way makeRaw found it.
+func (t *terminal) restore() error {
+	return ioctl(t.fd, ioctlSetTermios, unsafe.Pointer(&t.saved))
+}
+
+// size returns the number of columns and rows of the terminal.
+func (t *terminal) size() (int, int, error) {
+	var ws winsize
+	if err := ioctl(t.fd, unix.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	return int(ws.cols), int(ws.rows), nil
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// namedLayouts lets the common layouts be referred to by name rather than by
+// spelling out the reference time.
+var namedLayouts = map[string]string{
+	"ansic":       time.ANSIC,
+	"unixdate":    time.UnixDate,
+	"rfc822":      time.RFC822,
+	"rfc822z":     time.RFC822Z,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"stamp":       time.Stamp,
+	"stampmilli":  time.StampMilli,
+	"stampmicro":  time.StampMicro,
+}
+
+// timestampParser reads the time an event was logged at out of its text. The
+// pattern picks the timestamp out of the line, the first capture group is used
+// when it has one. Without a pattern the timestamp is taken to be at the start
+// of the line, spanning as many space seperated words as the layout does.
+type timestampParser struct {
+	layout  string
+	pattern *regexp.Regexp
+}
+
+// parseTimestampParser builds a timestampParser from the TimestampLayout and
+// TimestampPattern settings. A nil parser is returned when there is no layout.
+func parseTimestampParser(settings map[string]interface{}) (*timestampParser, error) {
+	layout := cast.ToString(settings["timestamplayout"])
+	if layout == "" {
+		return nil, nil
+	}
+	if named, ok := namedLayouts[strings.ToLower(layout)]; ok {
+		layout = named
+	}
+
+	p := &timestampParser{layout: layout}
+	if pattern := cast.ToString(settings["timestamppattern"]); pattern != "" {
+		var err error
+		if p.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parse returns the time the text was logged at, ok is false when the text
+// does not hold a timestamp in the parser's layout.
+func (p *timestampParser) parse(text string) (time.Time, bool) {
+	if p == nil {
+		return time.Time{}, false
+	}
+
+	var value string
+	if p.pattern != nil {
+		m := p.pattern.FindStringSubmatch(text)
+		if m == nil {
+			return time.Time{}, false
+		}
+		value = m[len(m)-1]
+		if len(m) > 1 {
+			value = m[1]
+		}
+	} else {
+		words := strings.Fields(text)
+		n := len(strings.Fields(p.layout))
+		if len(words) < n {
+			return time.Time{}, false
+		}
+		value = strings.Join(words[:n], " ")
+	}
+
+	t, err := time.ParseInLocation(p.layout, value, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	// Layouts such as the one syslog uses leave out the year.
+	if t.Year() == 0 {
+		t = t.AddDate(time.Now().Year(), 0, 0)
+	}
+	return t, true
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// tuiScrollback is how many lines the tui keeps around to scroll back
+	// through.
+	tuiScrollback = 10000
+
+	tuiSidebarWidth   = 30
+	tuiRedrawInterval = 100 * time.Millisecond
+	tuiMessageFor     = 5 * time.Second
+
+	tuiHelp = "q quit  p pause  / search  n/N next/prev  l/L level  tab select  t toggle  o only  a all"
+)
+
+var (
+	errNotATerminal = errors.New("the tui has to be run in a terminal")
+
+	// escapeSequence matches the escape sequences colored logs are full of.
+	escapeSequence = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+)
+
+// tuiSource is an entry in the tui's sidebar, the lines of sources that are
+// not enabled are hidden.
+type tuiSource struct {
+	path    string
+	label   string
+	enabled bool
+	count   int
+	rate    int
+}
+
+// tui is an interactive view of the aggregated events. It subscribes to the
+// hub like any other consumer, and keeps the newest tuiScrollback events to
+// scroll through. Lines are filtered by source and level as they are drawn,
+// so changing either applies to the lines already read too.
+type tui struct {
+	mu        sync.Mutex
+	term      *terminal
+	out       *bufio.Writer
+	hub       *hub
+	sub       *subscriber
+	ownsLog   bool
+	sources   []*tuiSource
+	byPath    map[string]*tuiSource
+	selected  int
+	lines     []*event
+	base      int
+	paused    bool
+	pausedAt  int
+	scroll    int
+	minLevel  level
+	search    string
+	searching bool
+	closed    bool
+	message   string
+	messageAt time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// startTUI takes over the terminal and starts showing the events handed to
+// the hub. The sidebar starts out with the locations that are files or syslog
+// listeners and the streams of commands. Files matched by patterns, the
+// connections of other listeners, docker containers and journal units are
+// added as their first line comes in. Unless ownsLog is false, our own
+// diagnostics are shown on the status line.
+func startTUI(h *hub, locations []location, ownsLog bool) (*tui, error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, errNotATerminal
+	}
+	term, err := makeRaw(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tui{
+		term:    term,
+		out:     bufio.NewWriterSize(os.Stdout, 64*1024),
+		hub:     h,
+		ownsLog: ownsLog,
+		byPath:  make(map[string]*tuiSource),
+		done:    make(chan struct{}),
+	}
+	for _, l := range locations {
+		switch {
+		case l.command != nil:
+			t.source(l.path+string(filepath.Separator)+"stdout", l.label+"/stdout")
+			t.source(l.path+string(filepath.Separator)+"stderr", l.label+"/stderr")
+		case l.listener != nil && !l.isSyslog(), l.docker != nil, l.journal != nil:
+			// Each connection, container or unit shows up once it sends
+			// its first line.
+		case !hasMeta(l.path) && !isDir(l.path):
+			t.source(l.path, l.label)
+		}
+	}
+	if ownsLog {
+		log.SetOutput(t)
+	}
+
+	// Use the alternate screen so the terminal is left as it was, and hide
+	// the cursor while we are drawing.
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	t.out.Flush()
+
+	t.sub = h.subscribe(eventFilter{}, -1)
+	t.wg.Add(2)
+	go t.receive()
+	go t.draw()
+	go t.readInput()
+	return t, nil
+}
+
+// close gives the terminal back the way we found it, it is safe to call more
+// than once.
+func (t *tui) close() {
+	t.closeOnce.Do(t.shutdown)
+}
+
+func (t *tui) shutdown() {
+	close(t.done)
+	t.hub.unsubscribe(t.sub)
+	t.wg.Wait()
+	if t.ownsLog {
+		log.SetOutput(os.Stderr)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	t.out.Flush()
+	t.term.restore()
+}
+
+// Write shows one of our own diagnostics on the status line for a while.
+func (t *tui) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.message = strings.TrimSpace(string(p))
+	t.messageAt = time.Now()
+	return len(p), nil
+}
+
+// source returns the sidebar entry for the path, adding it when it is new.
+// Callers hold the lock, or have not started the tui yet.
+func (t *tui) source(path, label string) *tuiSource {
+	if s, ok := t.byPath[path]; ok {
+		return s
+	}
+	if label == "" {
+		label = path
+	}
+	s := &tuiSource{path: path, label: label, enabled: true}
+	t.byPath[path] = s
+	t.sources = append(t.sources, s)
+	return s
+}
+
+// receive keeps the events from the subscription, dropping the oldest once
+// there are more than tuiScrollback of them.
+func (t *tui) receive() {
+	defer t.wg.Done()
+	for _, e := range t.sub.backlog {
+		t.add(e)
+	}
+	for e := range t.sub.events {
+		t.add(e)
+	}
+}
+
+func (t *tui) add(e *event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.source(e.Source, e.Label).count++
+	t.lines = append(t.lines, e)
+	if len(t.lines) > tuiScrollback {
+		t.lines[0] = nil
+		t.lines = t.lines[1:]
+		t.base++
+	}
+}
+
+// total is how many events we have received so far.
+func (t *tui) total() int {
+	return t.base + len(t.lines)
+}
+
+// draw redraws the screen every tuiRedrawInterval, and works out the line
+// rates of the sources every second.
+func (t *tui) draw() {
+	defer t.wg.Done()
+	redraw := time.NewTicker(tuiRedrawInterval)
+	defer redraw.Stop()
+	rates := time.NewTicker(time.Second)
+	defer rates.Stop()
+	for {
+		select {
+		case <-redraw.C:
+			t.render()
+		case <-rates.C:
+			t.mu.Lock()
+			for _, s := range t.sources {
+				s.rate = s.count
+				s.count = 0
+			}
+			t.mu.Unlock()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// shows reports whether the event is shown with the current filters.
+func (t *tui) shows(e *event) bool {
+	if s, ok := t.byPath[e.Source]; ok && !s.enabled {
+		return false
+	}
+	return t.minLevel == levelUnknown || e.Level >= t.minLevel
+}
+
+// visible calls fn with the events that are shown, newest first, along with
+// how many shown events are newer than it. Events that arrived after we were
+// paused are left out. It stops once fn returns false.
+func (t *tui) visible(fn func(rank int, e *event) bool) {
+	end := t.total()
+	if t.paused {
+		end = t.pausedAt
+	}
+	rank := 0
+	for i := end - t.base - 1; i >= 0; i-- {
+		e := t.lines[i]
+		if !t.shows(e) {
+			continue
+		}
+		if !fn(rank, e) {
+			return
+		}
+		rank++
+	}
+}
+
+// render draws the sidebar, the lines and the status line.
+func (t *tui) render() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cols, rows, err := t.term.size()
+	if t.closed || err != nil || cols < tuiSidebarWidth+10 || rows < 3 {
+		return
+	}
+	height := rows - 1
+	width := cols - tuiSidebarWidth - 1
+
+	// Collect the lines on screen, newest first, keeping scroll within the
+	// lines there are.
+	var shown []*event
+	t.visible(func(rank int, e *event) bool {
+		shown = append(shown, e)
+		return len(shown) < t.scroll+height
+	})
+	if t.scroll > len(shown)-height {
+		t.scroll = len(shown) - height
+	}
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+	shown = shown[t.scroll:]
+	if len(shown) > height {
+		shown = shown[:height]
+	}
+
+	fmt.Fprint(t.out, "\x1b[H")
+	for row := 0; row < height; row++ {
+		t.out.WriteString(t.sidebarRow(row, height))
+		t.out.WriteString("\x1b[90m│\x1b[0m")
+		if i := height - 1 - row; i < len(shown) {
+			t.out.WriteString(t.lineRow(shown[i], width))
+		}
+		t.out.WriteString("\x1b[K\r\n")
+	}
+	t.out.WriteString("\x1b[7m" + fitWidth(t.status(), cols) + "\x1b[0m")
+	t.out.Flush()
+}
+
+// sidebarRow draws a row of the sidebar, the first is a header and the rest
+// list the sources with how many lines a second they are writing. When there
+// are more sources than rows, the list is scrolled to the selected one.
+func (t *tui) sidebarRow(row, height int) string {
+	if row == 0 {
+		return "\x1b[1m" + fitWidth(" Sources          lines/s", tuiSidebarWidth) + "\x1b[0m"
+	}
+	i := row - 1
+	if t.selected >= height-1 {
+		i += t.selected - (height - 2)
+	}
+	if i >= len(t.sources) {
+		return strings.Repeat(" ", tuiSidebarWidth)
+	}
+	s := t.sources[i]
+	check := "[x]"
+	if !s.enabled {
+		check = "[ ]"
+	}
+	rate := fmt.Sprintf(" %5d", s.rate)
+	name := fitWidth(fmt.Sprintf(" %s %s", check, s.label), tuiSidebarWidth-len(rate))
+	cell := fmt.Sprintf("\x1b[%sm%s\x1b[0m%s", labelColor(s.label), name, rate)
+	if !s.enabled {
+		cell = "\x1b[90m" + name + rate + "\x1b[0m"
+	}
+	if i == t.selected {
+		cell = "\x1b[7m" + cell + "\x1b[0m"
+	}
+	return cell
+}
+
+// lineRow draws an event, cut off at width, with its label in the source's
+// color and its text in its level's color. Matches of the search are
+// highlighted.
+func (t *tui) lineRow(e *event, width int) string {
+	label := e.Label
+	if label == "" {
+		label = e.Source
+	}
+	prefix := []rune("[" + label + "] ")
+	if len(prefix) > width {
+		prefix = prefix[:width]
+	}
+	width -= len(prefix)
+
+	text := []rune(sanitize(e.Text))
+	if len(text) > width {
+		text = text[:width]
+	}
+	color := levelColors[e.Level]
+	var b strings.Builder
+	b.WriteString("\x1b[" + labelColor(label) + "m" + string(prefix) + "\x1b[0m")
+	if color != "" {
+		b.WriteString("\x1b[" + color + "m")
+	}
+
+	matches := searchMatches(text, t.search)
+	for i := 0; i < len(text); {
+		if n, ok := matches[i]; ok {
+			b.WriteString("\x1b[7m" + string(text[i:i+n]) + "\x1b[27m")
+			i += n
+			continue
+		}
+		b.WriteRune(text[i])
+		i++
+	}
+	b.WriteString("\x1b[0m")
+	return b.String()
+}
+
+// status describes what the tui is doing, along with the last of our own
+// diagnostics or the keys that can be used.
+func (t *tui) status() string {
+	parts := []string{" following"}
+	if t.paused {
+		parts[0] = fmt.Sprintf(" PAUSED (%d new)", t.total()-t.pausedAt)
+	}
+	if t.minLevel != levelUnknown {
+		parts = append(parts, "level >= "+t.minLevel.String())
+	}
+	if t.searching {
+		parts = append(parts, "search: "+t.search+"_")
+	} else if t.search != "" {
+		parts = append(parts, "search: "+t.search)
+	}
+	if t.message != "" && time.Since(t.messageAt) < tuiMessageFor {
+		parts = append(parts, t.message)
+	} else {
+		parts = append(parts, tuiHelp)
+	}
+	return strings.Join(parts, " | ")
+}
+
+// readInput handles the keys pressed until we are closed.
+func (t *tui) readInput() {
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		for _, key := range splitKeys(buf[:n]) {
+			if t.handleKey(key) {
+				select {
+				case closingChannel <- os.Interrupt:
+				default:
+				}
+				return
+			}
+		}
+		t.render()
+	}
+}
+
+// splitKeys splits what was read from the terminal into keys. A read can
+// hold more than one key when typing fast or pasting, each key is a single
+// character or the escape sequence of a key such as an arrow.
+func splitKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		n := 1
+		switch {
+		case b[0] == 0x1b && len(b) > 2 && b[1] == '[':
+			// Parameters are followed by a single final byte.
+			n = 2
+			for n < len(b) && (b[n] < 0x40 || b[n] > 0x7e) {
+				n++
+			}
+			if n < len(b) {
+				n++
+			}
+		case b[0] == 0x1b && len(b) > 2 && b[1] == 'O':
+			n = 3
+		case b[0] >= utf8.RuneSelf:
+			_, n = utf8.DecodeRune(b)
+		}
+		keys = append(keys, string(b[:n]))
+		b = b[n:]
+	}
+	return keys
+}
+
+// handleKey acts on a key, returning true when the user asked to quit.
+func (t *tui) handleKey(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.searching {
+		switch key {
+		case "\r", "\n":
+			t.searching = false
+			t.findMatch(true)
+		case "\x1b":
+			t.searching = false
+			t.search = ""
+		case "\x7f", "\b":
+			if r := []rune(t.search); len(r) > 0 {
+				t.search = string(r[:len(r)-1])
+			}
+		default:
+			if !strings.HasPrefix(key, "\x1b") && key != string(utf8.RuneError) {
+				t.search += sanitize(key)
+			}
+		}
+		return false
+	}
+
+	_, rows, _ := t.term.size()
+	page := rows - 2
+	switch key {
+	case "q", "\x03":
+		return true
+	case "p", " ":
+		t.setPaused(!t.paused)
+	case "\x1b[A", "k":
+		t.scrollBy(1)
+	case "\x1b[B", "j":
+		t.scrollBy(-1)
+	case "\x1b[5~":
+		t.scrollBy(page)
+	case "\x1b[6~":
+		t.scrollBy(-page)
+	case "\x1b[H", "\x1b[1~", "g":
+		t.scrollBy(tuiScrollback)
+	case "\x1b[F", "\x1b[4~", "G":
+		t.scroll = 0
+		t.setPaused(false)
+	case "\t":
+		t.moveSelection(1)
+	case "\x1b[Z":
+		t.moveSelection(-1)
+	case "t", "\r":
+		if t.selected < len(t.sources) {
+			s := t.sources[t.selected]
+			s.enabled = !s.enabled
+		}
+	case "o":
+		for i, s := range t.sources {
+			s.enabled = i == t.selected
+		}
+	case "a":
+		for _, s := range t.sources {
+			s.enabled = true
+		}
+	case "l":
+		t.minLevel = (t.minLevel + 1) % (levelFatal + 1)
+	case "L":
+		t.minLevel = (t.minLevel + levelFatal) % (levelFatal + 1)
+	case "/":
+		t.searching = true
+		t.search = ""
+	case "n":
+		t.findMatch(true)
+	case "N":
+		t.findMatch(false)
+	case "\x1b":
+		t.search = ""
+	}
+	return false
+}
+
+// setPaused pauses or resumes following new lines. While paused new lines
+// are still kept, they show up once we are resumed.
+func (t *tui) setPaused(paused bool) {
+	if paused && !t.paused {
+		t.pausedAt = t.total()
+	}
+	if !paused {
+		t.scroll = 0
+	}
+	t.paused = paused
+}
+
+// scrollBy scrolls back by n lines, or forward when n is negative. Scrolling
+// back pauses, so the lines do not move from under the reader.
+func (t *tui) scrollBy(n int) {
+	if n > 0 {
+		t.setPaused(true)
+	}
+	t.scroll += n
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+}
+
+func (t *tui) moveSelection(n int) {
+	if len(t.sources) == 0 {
+		return
+	}
+	t.selected = (t.selected + n + len(t.sources)) % len(t.sources)
+}
+
+// findMatch scrolls to the next line holding the search, older than the
+// newest line on screen when older is set, newer otherwise.
+func (t *tui) findMatch(older bool) {
+	if t.search == "" {
+		return
+	}
+	found := -1
+	t.visible(func(rank int, e *event) bool {
+		if older && rank <= t.scroll || !older && rank >= t.scroll {
+			return older
+		}
+		if len(searchMatches([]rune(sanitize(e.Text)), t.search)) > 0 {
+			found = rank
+			return !older
+		}
+		return true
+	})
+	if found < 0 {
+		t.message = "No more matches for: " + t.search
+		t.messageAt = time.Now()
+		return
+	}
+	t.setPaused(true)
+	t.scroll = found
+}
+
+// searchMatches finds where search occurs in text, ignoring case. The map
+// holds the length of each match keyed by the index it starts at.
+func searchMatches(text []rune, search string) map[int]int {
+	if search == "" {
+		return nil
+	}
+	lower := []rune(strings.ToLower(string(text)))
+	needle := []rune(strings.ToLower(search))
+	if len(lower) != len(text) {
+		return nil
+	}
+	matches := make(map[int]int)
+	for i := 0; i+len(needle) <= len(lower); {
+		if string(lower[i:i+len(needle)]) == string(needle) {
+			matches[i] = len(needle)
+			i += len(needle)
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// sanitize replaces tabs with a space and drops escape sequences and other
+// control characters, which would otherwise mess up the screen.
+func sanitize(s string) string {
+	s = escapeSequence.ReplaceAllString(s, "")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// fitWidth cuts s off at width runes, or pads it with spaces up to width.
+func fitWidth(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
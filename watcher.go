@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// patternWatcher watches the directories that may hold files matching one of
+// the patterns. When a matching file shows up it is added to the tailSet, and
+// when it goes away its tail is stopped.
+type patternWatcher struct {
+	watcher  *fsnotify.Watcher
+	mu       sync.Mutex
+	patterns []globPattern
+	tails    *tailSet
+	done     chan struct{}
+}
+
+// watchPatterns tails every file that currently matches the patterns and
+// starts watching for files that will match them later on.
+func watchPatterns(patterns []globPattern, tails *tailSet) (*patternWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	pw := &patternWatcher{watcher: w, patterns: patterns, tails: tails, done: make(chan struct{})}
+	for _, p := range patterns {
+		if err := pw.scan(p, p.root); err != nil {
+			log.Println("There was an issue while attmpting to watch the directory:", p.root)
+			w.Close()
+			return nil, err
+		}
+	}
+
+	go pw.run()
+	return pw, nil
+}
+
+// scan walks dir, watching each directory that could contain matches for the
+// pattern and tailing every file that does match it.
+func (pw *patternWatcher) scan(p globPattern, dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path != dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path != p.root && !p.mayContain(path) {
+				return filepath.SkipDir
+			}
+			return pw.watcher.Add(path)
+		}
+
+		if p.matches(path) {
+			if err := pw.tails.add(p.match(path)); err != nil {
+				log.Println("There was an issue while attmpting to aggregate log file located at:", path)
+				log.Println(err)
+			}
+		}
+		return nil
+	})
+}
+
+// run handles the events from the watcher until close is called.
+func (pw *patternWatcher) run() {
+	for {
+		select {
+		case event := <-pw.watcher.Events:
+			pw.handle(event)
+		case err := <-pw.watcher.Errors:
+			log.Println("Error while watching for new log files:", err)
+		case <-pw.done:
+			return
+		}
+	}
+}
+
+// handle starts tailing files and directories that were created, and stops
+// tailing the ones that were removed or renamed. A file that is renamed, such
+// as app.log being rotated to app.log.1, is only stopped once it shows up
+// under its new name, where the rest of it is read from. A file created in
+// its place is read as a new one.
+func (pw *patternWatcher) handle(event fsnotify.Event) {
+	event.Name = filepath.Clean(event.Name)
+	switch {
+	case event.Op&fsnotify.Remove != 0:
+		pw.tails.remove(event.Name)
+		return
+	case event.Op&fsnotify.Rename != 0:
+		if !pw.tails.tailing(event.Name) {
+			pw.tails.remove(event.Name)
+		}
+		return
+	case event.Op&fsnotify.Create == 0:
+		return
+	}
+
+	fi, err := os.Stat(event.Name)
+	if err != nil {
+		return
+	}
+	for _, p := range pw.current() {
+		switch {
+		case fi.IsDir() && p.mayContain(event.Name):
+			if err := pw.scan(p, event.Name); err != nil {
+				log.Println("Unable to watch new directory:", event.Name)
+				log.Println(err)
+			}
+		case !fi.IsDir() && p.matches(event.Name):
+			if pw.tails.renamed(event.Name, fi) || pw.tails.recreated(event.Name, fi) {
+				continue
+			}
+			// The file was just created, so everything within it is new
+			// no matter where we were asked to start.
+			l := p.match(event.Name)
+			l.options.start = startBeginning
+			log.Println("Started aggregating new log file:", event.Name)
+			if err := pw.tails.add(l); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// current returns the patterns being watched.
+func (pw *patternWatcher) current() []globPattern {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.patterns
+}
+
+// setPatterns replaces the patterns being watched. Files matching a pattern
+// that is new are not tailed until it is scanned.
+func (pw *patternWatcher) setPatterns(patterns []globPattern) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.patterns = patterns
+}
+
+// close stops watching for new files, the tails that were started are left
+// for closeTails.
+func (pw *patternWatcher) close() {
+	close(pw.done)
+	pw.watcher.Close()
+}
+
+// isWithin reports whether path lives somewhere beneath dir.
+func isWithin(dir, path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// fileID tells files apart by their device and inode.
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// identify returns the fileID of the file, ok is false when files have no
+// identity on this platform.
+func identify(fi os.FileInfo) (id fileID, ok bool) {
+	id.device, id.inode, ok = fileIdentity(fi)
+	return id, ok
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		host   string
+		origin string
+		same   bool
+	}{
+		{"localhost:8080", "", true},
+		{"localhost:8080", "http://localhost:8080", true},
+		{"localhost:8080", "http://LOCALHOST:8080", true},
+		{"localhost:8080", "http://localhost:9090", false},
+		{"localhost:8080", "https://evil.example.com", false},
+		{"localhost:8080", "null", false},
+		{"localhost:8080", "http://%zz", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Host = test.host
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if same := sameOrigin(r); same != test.same {
+			t.Errorf("got %v for %q on %s, want %v", same, test.origin, test.host, test.same)
+		}
+	}
+}